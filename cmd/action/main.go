@@ -4,6 +4,8 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zerologr"
@@ -21,7 +23,9 @@ func main() {
 	zl = zl.With().Caller().Timestamp().Logger().Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	logger := zerologr.New(&zl)
 
-	ctx := logr.NewContext(context.Background(), logger)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx = logr.NewContext(ctx, logger)
 	ghaction := githubactions.New()
 	cfg, err := renderaction.NewFromInputs(ghaction)
 	if err != nil {
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"gopkg.in/alecthomas/kingpin.v2"
 
@@ -10,43 +15,73 @@ import (
 	"github.com/rs/zerolog"
 	helmcli "helm.sh/helm/v3/pkg/cli"
 
+	"github.com/tobiash/flux-helm-preview/pkg/capabilities"
+	"github.com/tobiash/flux-helm-preview/pkg/discover"
+	"github.com/tobiash/flux-helm-preview/pkg/graph"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
 	"github.com/tobiash/flux-helm-preview/pkg/preview"
 )
 
-
 var (
 	app = kingpin.New("flux-helm-preview", "A tool to preview changes in Flux / Helm deployments.")
 
-	helmRegistryConfig   = app.Flag("registry-config", "Helm Registry Config").String()
-	helmRepositoryConfig = app.Flag("repository-config", "Helm Repository Config").String()
-	helmRepositoryCache  = app.Flag("repository-cache", "Helm Repository Cache").String()
+	helmRegistryConfig   = app.Flag("registry-config", "Helm Registry Config to use instead of a temporary one").String()
+	helmRepositoryConfig = app.Flag("repository-config", "Helm Repository Config to use instead of a temporary one").String()
+	helmRepositoryCache  = app.Flag("repository-cache", "Helm Repository Cache to use instead of a temporary one").String()
 
-	kustomizations = app.Flag("kustomization", "Kustomize base to render (relative to path)").Short('k').Required().Strings()
+	kustomizations = app.Flag("kustomization", "Kustomize base to render (relative to path)").Short('k').Strings()
+	discoverMode   = app.Flag("discover", "Discover kustomization roots to render, each as its own unit").PlaceHolder("MODE").Enum(discover.Modes...)
+	discoverIncl   = app.Flag("discover-include", "Glob of discovered paths to include").Strings()
+	discoverExcl   = app.Flag("discover-exclude", "Glob of discovered paths to exclude").Strings()
 	renderHelm     = app.Flag("render-helm", "Render HelmRelease objects").Short('H').Default("true").Bool()
+	fixturesDir    = app.Flag("fixtures", "Directory of objects visible to valuesFrom and substituteFrom, but not rendered").ExistingDir()
+	partial        = app.Flag("partial", "Continue when HelmReleases, Flux Kustomizations or kustomizations fail to render, and report the failures in the diff").Bool()
+	lenientValues  = app.Flag("lenient-values", "Ignore missing valuesFrom references of HelmReleases, even if not optional").Bool()
+	renderFlux     = app.Flag("render-flux", "Render Flux Kustomization objects").Short('F').Bool()
+	sourceMapFile  = app.Flag("source-map", "Flux source to local path mapping file").File()
+	credsFile      = app.Flag("credentials", "Chart repository credentials file").File()
+	cacheDir       = app.Flag("cache-dir", "Directory to keep chart repository indexes and charts in across runs").String()
+	cacheTTL       = app.Flag("cache-ttl", "Time after which cached chart repository indexes are refreshed").Default("10m").Duration()
+	lockFile       = app.Flag("lock-file", "File pinning the chart versions of HelmReleases, unlocked versions are added to it").String()
+	timeout        = app.Flag("timeout", "Time after which rendering is aborted, 0 for no timeout").Default("0").Duration()
+	chartTimeout   = app.Flag("chart-timeout", "Time after which rendering a single chart is aborted, 0 for no timeout").Default("5m").Duration()
+	concurrency    = app.Flag("concurrency", "Number of charts rendered concurrently").Default("8").Int()
+	hostConc       = app.Flag("host-concurrency", "Number of concurrent requests per chart repository host").Default("4").Int()
+	retries        = app.Flag("retries", "Number of retries of chart requests failing with transient errors").Default("3").Int()
+	offline        = app.Flag("offline", "Load charts only from the mirror directory, without network access").Bool()
+	mirrorDir      = app.Flag("mirror-dir", "Chart mirror directory used by --offline and the mirror command").String()
+
+	capabilitiesFile = app.Flag("capabilities", "Per-cluster Kubernetes version and API versions file").File()
+	kubeVersion      = app.Flag("kube-version", "Kubernetes version charts are rendered for").String()
+	apiVersions      = app.Flag("api-versions", "Additional API version available to charts").Strings()
+	apiVersionsFile  = app.Flag("api-versions-file", "Output of kubectl api-versions with API versions available to charts").ExistingFile()
+
+	ageKeyFile = app.Flag("age-key-file", "age key file used to decrypt SOPS encrypted resources. Decrypted values rendered into objects other than Secrets appear in plain text in the output").Envar("SOPS_AGE_KEY_FILE").File()
 
 	filtersFile = app.Flag("filter", "KIO filters definition file").File()
 
 	renderCmd  = app.Command("render", "Render a single path.")
 	renderPath = renderCmd.Arg("path", "Path to render.").Required().ExistingDir()
 
-	diffCmd   = app.Command("diff", "Diff two paths.")
-	diffPathA = diffCmd.Arg("a", "First path.").Required().ExistingDir()
-	diffPathB = diffCmd.Arg("b", "Second path.").Required().ExistingDir()
+	graphCmd    = app.Command("graph", "Print the dependency graph of Flux Kustomizations and HelmReleases.")
+	graphPath   = graphCmd.Arg("path", "Path to render.").Required().ExistingDir()
+	graphFormat = graphCmd.Flag("format", "Output format.").Default(graph.FormatDOT).Enum(graph.Formats...)
+
+	mirrorCmd   = app.Command("mirror", "Store the charts and chart repository indexes used to render paths in the mirror directory.")
+	mirrorPaths = mirrorCmd.Arg("paths", "Paths to render.").Required().ExistingDirs()
 
+	diffCmd   = app.Command("diff", "Diff two paths, or two refs of a git repository.")
+	diffGit   = diffCmd.Flag("git", "Git repository to read a and b from as refs.").PlaceHolder("REPO").ExistingDir()
+	diffPathA = diffCmd.Arg("a", "First path or git ref.").Required().String()
+	diffPathB = diffCmd.Arg("b", "Second path or git ref.").Required().String()
 )
 
-func helmSettings() *helmcli.EnvSettings {
-	settings := helmcli.New()
-	if helmRepositoryConfig != nil && *helmRepositoryConfig != "" {
-		settings.RepositoryConfig = *helmRepositoryConfig
-	}
-	if helmRegistryConfig != nil && *helmRegistryConfig != "" {
-		settings.RegistryConfig = *helmRegistryConfig
+// retryCount maps an explicit count of zero retries to helmrender.Limits, where zero means default
+func retryCount(n int) int {
+	if n == 0 {
+		return -1
 	}
-	if helmRepositoryCache != nil && *helmRepositoryCache != "" {
-		settings.RepositoryCache = *helmRepositoryCache
-	}
-	return settings
+	return n
 }
 
 func main() {
@@ -61,13 +96,99 @@ func main() {
 	kingpin.CommandLine.HelpFlag.Short('h')
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	opts := []preview.Opt{
+		preview.WithContext(ctx),
 		preview.WithLogger(log),
 		preview.WithKustomizations(*kustomizations),
+		preview.WithTimeout(*timeout, *chartTimeout),
+	}
+
+	if *discoverMode != "" {
+		opts = append(opts, preview.WithDiscovery(discover.Options{
+			Mode:    discover.Mode(*discoverMode),
+			Include: *discoverIncl,
+			Exclude: *discoverExcl,
+		}))
 	}
 
 	if renderHelm != nil && *renderHelm {
-		opts = append(opts, preview.WithHelm(helmSettings()))
+		opts = append(opts, preview.WithHelm(helmcli.New()))
+		opts = append(opts, preview.WithHelmConfig(helmrender.HelmConfig{
+			RepositoryConfig: *helmRepositoryConfig,
+			RepositoryCache:  *helmRepositoryCache,
+			RegistryConfig:   *helmRegistryConfig,
+		}))
+	}
+
+	opts = append(opts, preview.WithLimits(helmrender.Limits{
+		Concurrency:     *concurrency,
+		HostConcurrency: *hostConc,
+		Retries:         retryCount(*retries),
+	}))
+
+	if *lockFile != "" {
+		opts = append(opts, preview.WithLockFile(*lockFile))
+	}
+
+	if *cacheDir != "" {
+		opts = append(opts, preview.WithCache(*cacheDir, *cacheTTL))
+	}
+
+	if (*offline || cmd == mirrorCmd.FullCommand()) && *mirrorDir == "" {
+		app.Fatalf("--mirror-dir is required for --offline and the mirror command")
+	}
+	if cmd == mirrorCmd.FullCommand() {
+		if *offline {
+			app.Fatalf("--offline can not be used with the mirror command")
+		}
+		opts = append(opts, preview.WithMirror(*mirrorDir))
+	} else if *offline {
+		opts = append(opts, preview.WithOffline(*mirrorDir))
+	}
+
+	if *fixturesDir != "" {
+		opts = append(opts, preview.WithFixtures(*fixturesDir))
+	}
+
+	if *lenientValues {
+		opts = append(opts, preview.WithLenientValues())
+	}
+
+	if *partial {
+		opts = append(opts, preview.WithPartial())
+	}
+
+	if *renderFlux {
+		opts = append(opts, preview.WithFlux())
+	}
+
+	if *sourceMapFile != nil {
+		opts = append(opts, preview.WithSourceMapFile(*sourceMapFile))
+	}
+
+	if *credsFile != nil {
+		opts = append(opts, preview.WithCredentialsFile(*credsFile))
+	}
+
+	simpleCapabilities := *kubeVersion != "" || len(*apiVersions) > 0 || *apiVersionsFile != ""
+	if *capabilitiesFile != nil {
+		if simpleCapabilities {
+			app.Fatalf("--capabilities can not be combined with --kube-version, --api-versions or --api-versions-file")
+		}
+		opts = append(opts, preview.WithCapabilitiesFile(*capabilitiesFile))
+	} else if simpleCapabilities {
+		opts = append(opts, preview.WithCapabilities(capabilities.Config{Default: capabilities.Profile{
+			KubeVersion:     *kubeVersion,
+			APIVersions:     *apiVersions,
+			APIVersionsFile: *apiVersionsFile,
+		}}))
+	}
+
+	if *ageKeyFile != nil {
+		opts = append(opts, preview.WithAgeKeys(*ageKeyFile))
 	}
 
 	if *filtersFile != nil {
@@ -76,14 +197,53 @@ func main() {
 
 	p, err := preview.New(opts...)
 	app.FatalIfError(err, "error creating preview")
+	defer p.Close()
+
+	// kingpin exits without running deferred functions, close the preview to remove its
+	// temporary Helm home first
+	fatalf := func(format string, args ...interface{}) {
+		p.Close()
+		app.Fatalf(format, args...)
+	}
+	fatalIfError := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			p.Close()
+			app.FatalIfError(err, format, args...)
+		}
+	}
 
 	switch cmd {
 	case renderCmd.FullCommand():
 		err := p.Render(*renderPath, os.Stdout)
-		app.FatalIfError(err, "error rendering")
+		fatalIfError(err, "error rendering")
 
 	case diffCmd.FullCommand():
-		err := p.Diff(*diffPathA, *diffPathB, os.Stdout)
-		app.FatalIfError(err, "error creating diff")
+		if *diffGit != "" {
+			_, err := p.DiffGit(*diffGit, *diffPathA, *diffPathB, os.Stdout)
+			fatalIfError(err, "error creating diff")
+			break
+		}
+		for _, path := range []string{*diffPathA, *diffPathB} {
+			if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+				fatalf("path '%s' is not a directory", path)
+			}
+		}
+		_, err := p.Diff(*diffPathA, *diffPathB, os.Stdout)
+		fatalIfError(err, "error creating diff")
+
+	case mirrorCmd.FullCommand():
+		for _, path := range *mirrorPaths {
+			err := p.Render(path, io.Discard)
+			fatalIfError(err, "error mirroring charts of %s", path)
+		}
+
+	case graphCmd.FullCommand():
+		err := p.Graph(*graphPath, *graphFormat, os.Stdout)
+		var verr *graph.ValidationError
+		if errors.As(err, &verr) {
+			// the graph has been written, fail for its problems
+			fatalf("%s", verr)
+		}
+		fatalIfError(err, "error creating graph")
 	}
 }
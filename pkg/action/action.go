@@ -5,18 +5,45 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/go-logr/logr"
 	githubactions "github.com/sethvargo/go-githubactions"
+	"github.com/tobiash/flux-helm-preview/pkg/capabilities"
+	"github.com/tobiash/flux-helm-preview/pkg/discover"
+	"github.com/tobiash/flux-helm-preview/pkg/graph"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
 	"github.com/tobiash/flux-helm-preview/pkg/preview"
 	"helm.sh/helm/v3/pkg/cli"
 )
 
 type Config struct {
 	Helm             bool
+	LenientValues    bool
+	Partial          bool
+	Fixtures         string
+	Flux             bool
+	SourceMap        string
+	Credentials      string
+	Offline          bool
+	MirrorDir        string
+	CacheDir         string
+	CacheTTL         time.Duration
+	Limits           helmrender.Limits
+	LockFile         string
+	Timeout          time.Duration
+	ChartTimeout     time.Duration
+	AgeKey           string
+	Capabilities     string
+	KubeVersion      string
+	APIVersions      []string
 	Kustomizations   []string
+	Discover         string
+	DiscoverInclude  []string
+	DiscoverExclude  []string
 	RepoA            string
 	RepoB            string
 	WriteMarkdown    string
@@ -26,7 +53,7 @@ type Config struct {
 
 type Action struct {
 	ctx     context.Context
-	cfg Config
+	cfg     Config
 	action  *githubactions.Action
 	preview *preview.Preview
 }
@@ -36,10 +63,27 @@ type MarkdownContext struct {
 	RepoA          string
 	RepoB          string
 	Kustomizations []string
+	// Graph is the dependency graph of repository B in Mermaid format
+	Graph               string
+	DependenciesChanged bool
+	// RenderErrors are the releases, kustomizations and units which failed to render with partial
+	RenderErrors []preview.RenderError
+	// DependencyErrors are the missing and cyclic dependencies of both repositories
+	DependencyErrors []preview.DependencyError
+}
+
+// inputList returns the non-empty lines of a newline separated input
+func inputList(action *githubactions.Action, name string) []string {
+	var result []string
+	for _, l := range strings.Split(action.GetInput(name), "\n") {
+		if ls := strings.TrimSpace(l); ls != "" {
+			result = append(result, ls)
+		}
+	}
+	return result
 }
 
 func NewFromInputs(action *githubactions.Action) (*Config, error) {
-	kustomizations := strings.Split(action.GetInput("kustomizations"), "\n")
 	cfg := &Config{
 		RepoA: action.GetInput("repo-a"),
 		RepoB: action.GetInput("repo-b"),
@@ -50,12 +94,82 @@ func NewFromInputs(action *githubactions.Action) (*Config, error) {
 	if action.GetInput("helm") == "true" {
 		cfg.Helm = true
 	}
-	for _, k := range kustomizations {
-		ks := strings.TrimSpace(k)
-		if ks != "" {
-			cfg.Kustomizations = append(cfg.Kustomizations, ks)
+	if action.GetInput("lenient-values") == "true" {
+		cfg.LenientValues = true
+	}
+	if action.GetInput("partial") == "true" {
+		cfg.Partial = true
+	}
+	if action.GetInput("flux") == "true" {
+		cfg.Flux = true
+	}
+	cfg.SourceMap = action.GetInput("source-map")
+	cfg.Fixtures = action.GetInput("fixtures")
+	cfg.Credentials = action.GetInput("credentials")
+	cfg.CacheDir = action.GetInput("cache-dir")
+	if ttl := action.GetInput("cache-ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache-ttl: %w", err)
+		}
+		cfg.CacheTTL = d
+	}
+	for _, in := range []struct {
+		name  string
+		value *int
+	}{
+		{"concurrency", &cfg.Limits.Concurrency},
+		{"host-concurrency", &cfg.Limits.HostConcurrency},
+		{"retries", &cfg.Limits.Retries},
+	} {
+		if v := action.GetInput(in.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", in.name, err)
+			}
+			*in.value = n
+		}
+	}
+	if cfg.Limits.Retries == 0 && action.GetInput("retries") != "" {
+		cfg.Limits.Retries = -1
+	}
+	cfg.LockFile = action.GetInput("lock-file")
+	for _, in := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"timeout", &cfg.Timeout},
+		{"chart-timeout", &cfg.ChartTimeout},
+	} {
+		if v := action.GetInput(in.name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", in.name, err)
+			}
+			*in.value = d
 		}
 	}
+	cfg.MirrorDir = action.GetInput("mirror-dir")
+	if action.GetInput("offline") == "true" {
+		if cfg.MirrorDir == "" {
+			return nil, fmt.Errorf("offline requires mirror-dir")
+		}
+		cfg.Offline = true
+	}
+	cfg.AgeKey = action.GetInput("age-key")
+	cfg.Capabilities = action.GetInput("capabilities")
+	cfg.KubeVersion = action.GetInput("kube-version")
+	cfg.APIVersions = inputList(action, "api-versions")
+	if cfg.Capabilities != "" && (cfg.KubeVersion != "" || len(cfg.APIVersions) > 0) {
+		return nil, fmt.Errorf("capabilities can not be combined with kube-version or api-versions")
+	}
+	cfg.Kustomizations = inputList(action, "kustomizations")
+	cfg.Discover = action.GetInput("discover")
+	cfg.DiscoverInclude = inputList(action, "discover-include")
+	cfg.DiscoverExclude = inputList(action, "discover-exclude")
+	if len(cfg.Kustomizations) == 0 && cfg.Discover == "" {
+		return nil, fmt.Errorf("must configure kustomizations or discover")
+	}
 	cfg.WriteMarkdown = action.GetInput("write-markdown")
 	cfg.MarkdownTemplate = action.GetInput("markdown-template")
 	cfg.Filter = action.GetInput("filter")
@@ -65,12 +179,60 @@ func NewFromInputs(action *githubactions.Action) (*Config, error) {
 func NewAction(ctx context.Context, cfg *Config, ghaction *githubactions.Action) (*Action, error) {
 	log := logr.FromContextOrDiscard(ctx)
 	opts := []preview.Opt{
+		preview.WithContext(ctx),
 		preview.WithLogger(log),
 		preview.WithKustomizations(cfg.Kustomizations),
+		preview.WithTimeout(cfg.Timeout, cfg.ChartTimeout),
+	}
+	if cfg.Discover != "" {
+		opts = append(opts, preview.WithDiscovery(discover.Options{
+			Mode:    discover.Mode(cfg.Discover),
+			Include: cfg.DiscoverInclude,
+			Exclude: cfg.DiscoverExclude,
+		}))
+	}
+	if cfg.Flux {
+		opts = append(opts, preview.WithFlux())
+	}
+	if cfg.SourceMap != "" {
+		opts = append(opts, preview.WithSourceMapYAML(cfg.SourceMap))
+	}
+	if cfg.Credentials != "" {
+		opts = append(opts, preview.WithCredentialsYAML(cfg.Credentials))
+	}
+	if cfg.Capabilities != "" {
+		opts = append(opts, preview.WithCapabilitiesYAML(cfg.Capabilities))
+	} else if cfg.KubeVersion != "" || len(cfg.APIVersions) > 0 {
+		opts = append(opts, preview.WithCapabilities(capabilities.Config{Default: capabilities.Profile{
+			KubeVersion: cfg.KubeVersion,
+			APIVersions: cfg.APIVersions,
+		}}))
+	}
+	if cfg.AgeKey != "" {
+		opts = append(opts, preview.WithAgeKeys(strings.NewReader(cfg.AgeKey)))
 	}
 	if cfg.Helm {
 		opts = append(opts, preview.WithHelm(cli.New()))
 	}
+	opts = append(opts, preview.WithLimits(cfg.Limits))
+	if cfg.LockFile != "" {
+		opts = append(opts, preview.WithLockFile(cfg.LockFile))
+	}
+	if cfg.CacheDir != "" {
+		opts = append(opts, preview.WithCache(cfg.CacheDir, cfg.CacheTTL))
+	}
+	if cfg.Offline {
+		opts = append(opts, preview.WithOffline(cfg.MirrorDir))
+	}
+	if cfg.Fixtures != "" {
+		opts = append(opts, preview.WithFixtures(cfg.Fixtures))
+	}
+	if cfg.LenientValues {
+		opts = append(opts, preview.WithLenientValues())
+	}
+	if cfg.Partial {
+		opts = append(opts, preview.WithPartial())
+	}
 	if cfg.Filter != "" {
 		opts = append(opts, preview.WithFilterYAML(cfg.Filter))
 	}
@@ -81,9 +243,9 @@ func NewAction(ctx context.Context, cfg *Config, ghaction *githubactions.Action)
 	}
 
 	action := Action{
-		ctx:    ctx,
-		cfg: *cfg,
-		action: ghaction,
+		ctx:     ctx,
+		cfg:     *cfg,
+		action:  ghaction,
 		preview: p,
 	}
 
@@ -91,24 +253,34 @@ func NewAction(ctx context.Context, cfg *Config, ghaction *githubactions.Action)
 }
 
 func (a *Action) Run() error {
+	defer a.preview.Close()
 	var buf bytes.Buffer
-	if err := a.preview.Diff(a.cfg.RepoA, a.cfg.RepoB, &buf); err != nil {
+	result, err := a.preview.Diff(a.cfg.RepoA, a.cfg.RepoB, &buf)
+	if err != nil {
 		return err
 	}
 	// a.action.AddStepSummary(fmt.Sprintf("```\n%s\n```", string(buf.Bytes())))
 	a.action.SetOutput("diff", string(buf.Bytes()))
 	if a.cfg.WriteMarkdown != "" {
-		return a.writeMarkdown(string(buf.Bytes()))
+		return a.writeMarkdown(string(buf.Bytes()), result)
 	}
 	return nil
 }
 
-func (a *Action) writeMarkdown(diff string) error {
+func (a *Action) writeMarkdown(diff string, result *preview.DiffResult) error {
+	var graphBuf bytes.Buffer
+	if err := result.GraphB.Write(&graphBuf, graph.FormatMermaid); err != nil {
+		return err
+	}
 	mdCtx := MarkdownContext{
-		Diff:           diff,
-		RepoA:          a.cfg.RepoA,
-		RepoB:          a.cfg.RepoB,
-		Kustomizations: a.cfg.Kustomizations,
+		Diff:                diff,
+		RepoA:               a.cfg.RepoA,
+		RepoB:               a.cfg.RepoB,
+		Kustomizations:      a.cfg.Kustomizations,
+		Graph:               graphBuf.String(),
+		DependenciesChanged: result.DependenciesChanged(),
+		RenderErrors:        result.RenderErrors,
+		DependencyErrors:    result.DependencyErrors,
 	}
 	tpl, err := template.New("markdown").Parse(a.cfg.MarkdownTemplate)
 	if err != nil {
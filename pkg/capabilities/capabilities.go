@@ -0,0 +1,123 @@
+package capabilities
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// Profile describes the capabilities charts can query with .Capabilities
+type Profile struct {
+	KubeVersion string   `yaml:"kubeVersion,omitempty"`
+	APIVersions []string `yaml:"apiVersions,omitempty"`
+	// APIVersionsFile is a file with the output of `kubectl api-versions`
+	APIVersionsFile string `yaml:"apiVersionsFile,omitempty"`
+}
+
+// Config holds a default profile and profiles for clusters, keyed by the path of the rendered unit
+type Config struct {
+	Default  Profile            `yaml:"default"`
+	Clusters map[string]Profile `yaml:"clusters,omitempty"`
+}
+
+// Capabilities are the resolved values of a profile
+type Capabilities struct {
+	KubeVersion *chartutil.KubeVersion
+	APIVersions []string
+}
+
+// Profiles resolves the capabilities of rendered units
+type Profiles struct {
+	def      *Capabilities
+	clusters map[string]*Capabilities
+}
+
+// Load reads profiles from r, resolving relative paths against baseDir
+func Load(r io.Reader, baseDir string) (*Profiles, error) {
+	var cfg Config
+	if err := yaml.NewDecoder(r).Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error parsing capabilities: %w", err)
+	}
+	return New(cfg, baseDir)
+}
+
+func New(cfg Config, baseDir string) (*Profiles, error) {
+	def, err := resolve(cfg.Default, &Capabilities{}, baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("default capabilities: %w", err)
+	}
+	p := &Profiles{def: def, clusters: map[string]*Capabilities{}}
+	for name, profile := range cfg.Clusters {
+		c, err := resolve(profile, def, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("capabilities of cluster %s: %w", name, err)
+		}
+		p.clusters[filepath.Clean(name)] = c
+	}
+	return p, nil
+}
+
+// resolve parses profile, inheriting the kube version and API versions of base
+func resolve(profile Profile, base *Capabilities, baseDir string) (*Capabilities, error) {
+	c := &Capabilities{
+		KubeVersion: base.KubeVersion,
+		APIVersions: append(append([]string{}, base.APIVersions...), profile.APIVersions...),
+	}
+	if profile.KubeVersion != "" {
+		v, err := chartutil.ParseKubeVersion(profile.KubeVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kube version '%s': %w", profile.KubeVersion, err)
+		}
+		c.KubeVersion = v
+	}
+	if profile.APIVersionsFile != "" {
+		p := profile.APIVersionsFile
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(baseDir, p)
+		}
+		versions, err := readAPIVersions(p)
+		if err != nil {
+			return nil, err
+		}
+		c.APIVersions = append(c.APIVersions, versions...)
+	}
+	return c, nil
+}
+
+func readAPIVersions(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading API versions: %w", err)
+	}
+	defer f.Close()
+	var versions []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v := strings.TrimSpace(s.Text()); v != "" {
+			versions = append(versions, v)
+		}
+	}
+	return versions, s.Err()
+}
+
+// For returns the capabilities of the unit at path, from the profile of the closest enclosing
+// cluster or the default profile. It returns nil if p is nil.
+func (p *Profiles) For(path string) *Capabilities {
+	if p == nil {
+		return nil
+	}
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if c, ok := p.clusters[dir]; ok {
+			return c
+		}
+		if dir == "." || dir == "/" {
+			return p.def
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package capabilities_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tobiash/flux-helm-preview/pkg/capabilities"
+)
+
+func TestProfiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "prod-api-versions.txt"), []byte("v1\nmonitoring.coreos.com/v1\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := capabilities.Load(strings.NewReader(`
+default:
+  kubeVersion: "1.24.0"
+  apiVersions: [example.com/v1]
+clusters:
+  clusters/prod:
+    kubeVersion: v1.25.3
+    apiVersionsFile: prod-api-versions.txt
+  clusters/staging: {}
+`), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		unit        string
+		kubeVersion string
+		apiVersions []string
+	}{
+		{"", "v1.24.0", []string{"example.com/v1"}},
+		{"apps", "v1.24.0", []string{"example.com/v1"}},
+		{"clusters/prod", "v1.25.3", []string{"example.com/v1", "v1", "monitoring.coreos.com/v1"}},
+		{"clusters/prod/flux-system", "v1.25.3", []string{"example.com/v1", "v1", "monitoring.coreos.com/v1"}},
+		{"clusters/staging", "v1.24.0", []string{"example.com/v1"}},
+	}
+	for _, tt := range tests {
+		c := p.For(tt.unit)
+		if c.KubeVersion.Version != tt.kubeVersion || !reflect.DeepEqual(c.APIVersions, tt.apiVersions) {
+			t.Errorf("unexpected capabilities of '%s': %s %v", tt.unit, c.KubeVersion.Version, c.APIVersions)
+		}
+	}
+
+	if _, err := capabilities.New(capabilities.Config{Default: capabilities.Profile{KubeVersion: "latest"}}, ""); err == nil {
+		t.Error("expected invalid kube version to fail")
+	}
+}
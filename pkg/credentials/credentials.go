@@ -0,0 +1,84 @@
+package credentials
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Repository holds the credentials of chart repositories whose URL starts with URL.
+// Username and password may reference environment variables as $VAR or ${VAR}.
+type Repository struct {
+	URL                   string `yaml:"url"`
+	Username              string `yaml:"username,omitempty"`
+	Password              string `yaml:"password,omitempty"`
+	CAFile                string `yaml:"caFile,omitempty"`
+	CertFile              string `yaml:"certFile,omitempty"`
+	KeyFile               string `yaml:"keyFile,omitempty"`
+	InsecureSkipTLSVerify bool   `yaml:"insecureSkipTLSVerify,omitempty"`
+	PassCredentials       bool   `yaml:"passCredentials,omitempty"`
+}
+
+// Config is the content of a credentials file
+type Config struct {
+	Repositories []Repository `yaml:"repositories"`
+}
+
+// Credentials resolves the credentials of chart repositories
+type Credentials struct {
+	repositories []Repository
+}
+
+// Load reads credentials from r, resolving relative paths against baseDir
+func Load(r io.Reader, baseDir string) (*Credentials, error) {
+	var cfg Config
+	if err := yaml.NewDecoder(r).Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error parsing credentials: %w", err)
+	}
+	return New(cfg, baseDir)
+}
+
+func New(cfg Config, baseDir string) (*Credentials, error) {
+	c := &Credentials{}
+	for _, repo := range cfg.Repositories {
+		if repo.URL == "" {
+			return nil, fmt.Errorf("credentials without url")
+		}
+		repo.URL = normalize(repo.URL)
+		repo.Username = os.ExpandEnv(repo.Username)
+		repo.Password = os.ExpandEnv(repo.Password)
+		for _, p := range []*string{&repo.CAFile, &repo.CertFile, &repo.KeyFile} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(baseDir, *p)
+			}
+		}
+		c.repositories = append(c.repositories, repo)
+	}
+	return c, nil
+}
+
+// For returns the credentials with the longest URL prefix of url, or nil if there are none.
+// It returns nil if c is nil.
+func (c *Credentials) For(url string) *Repository {
+	if c == nil {
+		return nil
+	}
+	url = normalize(url)
+	var match *Repository
+	for i, repo := range c.repositories {
+		if !strings.HasPrefix(url, repo.URL) || (match != nil && len(match.URL) >= len(repo.URL)) {
+			continue
+		}
+		match = &c.repositories[i]
+	}
+	return match
+}
+
+// normalize appends a slash so https://a.io/charts does not match https://a.io/charts-private
+func normalize(url string) string {
+	return strings.TrimSuffix(url, "/") + "/"
+}
@@ -0,0 +1,61 @@
+package credentials_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tobiash/flux-helm-preview/pkg/credentials"
+)
+
+func TestFor(t *testing.T) {
+	t.Setenv("CHARTS_TOKEN", "token")
+	c, err := credentials.Load(strings.NewReader(`
+repositories:
+- url: https://charts.example.com
+  username: ci
+  password: ${CHARTS_TOKEN}
+- url: https://charts.example.com/private/
+  username: private
+  caFile: ca.crt
+- url: oci://registry.example.com/charts
+  username: oci
+`), "/etc/flux")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url      string
+		username string
+	}{
+		{"https://charts.example.com", "ci"},
+		{"https://charts.example.com/public", "ci"},
+		{"https://charts.example.com/private", "private"},
+		{"https://charts.example.com.evil.io", ""},
+		{"oci://registry.example.com/charts/", "oci"},
+		{"oci://registry.example.com/charts-other", ""},
+	}
+	for _, tt := range tests {
+		repo := c.For(tt.url)
+		if tt.username == "" {
+			if repo != nil {
+				t.Errorf("%s: expected no credentials, got %s", tt.url, repo.Username)
+			}
+			continue
+		}
+		if repo == nil || repo.Username != tt.username {
+			t.Errorf("%s: expected credentials of %s, got %v", tt.url, tt.username, repo)
+		}
+	}
+
+	if repo := c.For("https://charts.example.com"); repo.Password != "token" {
+		t.Errorf("expected password from environment, got %q", repo.Password)
+	}
+	if repo := c.For("https://charts.example.com/private"); repo.CAFile != "/etc/flux/ca.crt" {
+		t.Errorf("expected CA file relative to the credentials file, got %s", repo.CAFile)
+	}
+	var none *credentials.Credentials
+	if none.For("https://charts.example.com") != nil {
+		t.Error("expected no credentials from nil")
+	}
+}
@@ -8,10 +8,22 @@ import (
 	"github.com/hexops/gotextdiff/myers"
 	"github.com/hexops/gotextdiff/span"
 	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"sigs.k8s.io/kustomize/api/resource"
 	"sigs.k8s.io/kustomize/kyaml/resid"
 )
 
-func Diff(a, b *render.Render, w io.Writer) (error) {
+func Diff(a, b *render.Render, w io.Writer) error {
+	return DiffUnit("", a, b, w)
+}
+
+// DiffUnit diffs a single rendered unit, prefixing all file names with the unit name
+func DiffUnit(unit string, a, b *render.Render, w io.Writer) error {
+	name := func(id resid.ResId) string {
+		if unit == "" {
+			return id.String()
+		}
+		return unit + "/" + id.String()
+	}
 	var added, deleted, modified []resid.ResId
 	for _, ra := range a.Resources() {
 		if _, err := b.GetByCurrentId(ra.CurId()); err != nil {
@@ -29,24 +41,43 @@ func Diff(a, b *render.Render, w io.Writer) (error) {
 	for _, c := range added {
 		r, _ := b.GetByCurrentId(c)
 		yaml := r.MustYaml()
-		edits := myers.ComputeEdits(span.URIFromPath(c.String()), "", yaml)
-		fmt.Fprint(w, gotextdiff.ToUnified(c.String(), c.String(), "", edits))
+		edits := myers.ComputeEdits(span.URIFromPath(name(c)), "", yaml)
+		fmt.Fprint(w, gotextdiff.ToUnified(name(c), name(c), "", edits))
 	}
 
+	byFate := map[fate][]*resource.Resource{}
+	p := newPruner(a, b)
 	for _, d := range deleted {
 		r, _ := a.GetByCurrentId(d)
-		yaml := r.MustYaml()
-		edits := myers.ComputeEdits(span.URIFromPath(d.String()), yaml, "")
-		fmt.Fprint(w, gotextdiff.ToUnified(d.String(), d.String(), yaml, edits))
+		f := p.fate(r)
+		byFate[f] = append(byFate[f], r)
+	}
+	for _, group := range []struct {
+		title     string
+		resources []*resource.Resource
+	}{
+		{"will be pruned", byFate[pruned]},
+		{"will be orphaned", byFate[orphaned]},
+		{"deleted (owner unknown)", byFate[ownerUnknown]},
+	} {
+		if len(group.resources) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# %s\n", group.title)
+		for _, r := range group.resources {
+			yaml := r.MustYaml()
+			edits := myers.ComputeEdits(span.URIFromPath(name(r.CurId())), yaml, "")
+			fmt.Fprint(w, gotextdiff.ToUnified(name(r.CurId()), name(r.CurId()), yaml, edits))
+		}
 	}
 
 	for _, m := range modified {
 		ar, _ := a.GetByCurrentId(m)
 		br, _ := b.GetByCurrentId(m)
 
-		edits := myers.ComputeEdits(span.URIFromPath(m.String()), ar.MustYaml(), br.MustYaml())
-		fmt.Fprint(w, gotextdiff.ToUnified(m.String(), m.String(), ar.MustYaml(), edits))
+		edits := myers.ComputeEdits(span.URIFromPath(name(m)), ar.MustYaml(), br.MustYaml())
+		fmt.Fprint(w, gotextdiff.ToUnified(name(m), name(m), ar.MustYaml(), edits))
 	}
 	return nil
 
-}
\ No newline at end of file
+}
@@ -0,0 +1,107 @@
+package diff_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/diff"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+const kustomizations = `apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
+kind: Kustomization
+metadata:
+  name: apps
+  namespace: flux-system
+spec:
+  prune: true
+---
+apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
+kind: Kustomization
+metadata:
+  name: legacy
+  namespace: flux-system
+spec:
+  prune: false
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: db
+  namespace: default
+`
+
+func configMap(name string, labels map[string]string, annotations map[string]string) string {
+	s := "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\n  namespace: default\n  labels:\n"
+	for k, v := range labels {
+		s += "    " + k + ": " + v + "\n"
+	}
+	if len(annotations) > 0 {
+		s += "  annotations:\n"
+		for k, v := range annotations {
+			s += "    " + k + ": " + v + "\n"
+		}
+	}
+	return s
+}
+
+func testRender(t *testing.T, content string) *render.Render {
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/all.yaml", []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, "/repo"); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestDiffPrune(t *testing.T) {
+	apps := map[string]string{"kustomize.toolkit.fluxcd.io/name": "apps", "kustomize.toolkit.fluxcd.io/namespace": "flux-system"}
+	legacy := map[string]string{"kustomize.toolkit.fluxcd.io/name": "legacy", "kustomize.toolkit.fluxcd.io/namespace": "flux-system"}
+	helm := map[string]string{"helm.toolkit.fluxcd.io/name": "db", "helm.toolkit.fluxcd.io/namespace": "default"}
+	gone := map[string]string{"kustomize.toolkit.fluxcd.io/name": "gone", "kustomize.toolkit.fluxcd.io/namespace": "flux-system"}
+
+	a := testRender(t, kustomizations+
+		configMap("pruned", apps, nil)+
+		configMap("disabled", apps, map[string]string{"kustomize.toolkit.fluxcd.io/prune": "disabled"})+
+		configMap("no-prune", legacy, nil)+
+		configMap("helm-pruned", helm, nil)+
+		configMap("helm-keep", helm, map[string]string{"helm.sh/resource-policy": "keep"})+
+		configMap("unlabeled", nil, nil)+
+		configMap("unknown-owner", gone, nil))
+	b := testRender(t, kustomizations)
+
+	var buf bytes.Buffer
+	if err := diff.Diff(a, b, &buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	pruned, rest, ok := strings.Cut(out, "# will be orphaned\n")
+	if !ok || !strings.HasPrefix(pruned, "# will be pruned\n") {
+		t.Fatalf("unexpected diff:\n%s", out)
+	}
+	orphaned, unknown, ok := strings.Cut(rest, "# deleted (owner unknown)\n")
+	if !ok {
+		t.Fatalf("unexpected diff:\n%s", out)
+	}
+	for _, name := range []string{"pruned", "helm-pruned"} {
+		if !strings.Contains(pruned, "ConfigMap.v1.[noGrp]/"+name+".default") {
+			t.Errorf("expected %s to be pruned:\n%s", name, out)
+		}
+	}
+	for _, name := range []string{"disabled", "no-prune", "helm-keep"} {
+		if !strings.Contains(orphaned, "ConfigMap.v1.[noGrp]/"+name+".default") {
+			t.Errorf("expected %s to be orphaned:\n%s", name, out)
+		}
+	}
+	for _, name := range []string{"unlabeled", "unknown-owner"} {
+		if !strings.Contains(unknown, "ConfigMap.v1.[noGrp]/"+name+".default") {
+			t.Errorf("expected the owner of %s to be unknown:\n%s", name, out)
+		}
+	}
+}
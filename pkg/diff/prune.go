@@ -0,0 +1,105 @@
+package diff
+
+import (
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+const (
+	kustomizeGroup = "kustomize.toolkit.fluxcd.io"
+	helmGroup      = "helm.toolkit.fluxcd.io"
+
+	pruneAnnotation          = kustomizeGroup + "/prune"
+	resourcePolicyAnnotation = "helm.sh/resource-policy"
+)
+
+// fate is what happens to an object in the cluster when it is deleted from the repository
+type fate int
+
+const (
+	pruned fate = iota
+	orphaned
+	// ownerUnknown is the fate of objects without Flux origin labels, or whose owner is not
+	// part of the render
+	ownerUnknown
+)
+
+// pruner decides whether an object that is missing from b gets deleted from the cluster.
+// Ownership is derived from the origin labels set by kustomize- and helm-controller.
+type pruner struct {
+	a, b     *render.Render
+	visiting map[string]bool
+}
+
+func newPruner(a, b *render.Render) *pruner {
+	return &pruner{a: a, b: b, visiting: map[string]bool{}}
+}
+
+// fate reports what happens to res, which exists in a but not in b
+func (p *pruner) fate(res *resource.Resource) fate {
+	key := res.CurId().String()
+	if p.visiting[key] {
+		return ownerUnknown
+	}
+	p.visiting[key] = true
+	defer delete(p.visiting, key)
+
+	labels := res.GetLabels()
+	if name, ok := labels[helmGroup+"/name"]; ok {
+		if res.GetAnnotations()[resourcePolicyAnnotation] == "keep" {
+			return orphaned
+		}
+		if find(p.b, helmGroup, "HelmRelease", labels[helmGroup+"/namespace"], name) != nil {
+			return pruned
+		}
+		// The release is uninstalled if the HelmRelease is deleted
+		if hr := find(p.a, helmGroup, "HelmRelease", labels[helmGroup+"/namespace"], name); hr != nil {
+			return p.fate(hr)
+		}
+		return ownerUnknown
+	}
+
+	if res.GetAnnotations()[pruneAnnotation] == "disabled" || labels[pruneAnnotation] == "disabled" {
+		return orphaned
+	}
+	if name, ok := labels[kustomizeGroup+"/name"]; ok {
+		if ks := find(p.b, kustomizeGroup, "Kustomization", labels[kustomizeGroup+"/namespace"], name); ks != nil {
+			return pruneFate(ks)
+		}
+		// A deleted Kustomization garbage collects its objects only if it is deleted itself
+		if ks := find(p.a, kustomizeGroup, "Kustomization", labels[kustomizeGroup+"/namespace"], name); ks != nil {
+			if pruneFate(ks) == orphaned {
+				return orphaned
+			}
+			return p.fate(ks)
+		}
+	}
+	return ownerUnknown
+}
+
+func pruneFate(ks *resource.Resource) fate {
+	if prune(ks) {
+		return pruned
+	}
+	return orphaned
+}
+
+func prune(ks *resource.Resource) bool {
+	m, err := ks.Map()
+	if err != nil {
+		return false
+	}
+	spec, _ := m["spec"].(map[string]interface{})
+	prune, _ := spec["prune"].(bool)
+	return prune
+}
+
+func find(r *render.Render, group, kind, namespace, name string) *resource.Resource {
+	for _, res := range r.Resources() {
+		gvk := res.GetGvk()
+		if gvk.Group == group && gvk.Kind == kind && res.GetNamespace() == namespace && res.GetName() == name {
+			return res
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package discover
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-zglob"
+	"sigs.k8s.io/kustomize/api/konfig"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/yaml"
+)
+
+type Mode string
+
+const (
+	// ModeKustomize finds kustomizations that are not referenced by any other kustomization
+	ModeKustomize Mode = "kustomize"
+	// ModeFlux finds Flux cluster entrypoints, i.e. directories containing a bootstrapped flux-system
+	ModeFlux Mode = "flux"
+)
+
+var Modes = []string{string(ModeKustomize), string(ModeFlux)}
+
+type Options struct {
+	Mode    Mode
+	Include []string
+	Exclude []string
+}
+
+// Discover walks root and returns the paths (relative to root) of all units to render
+func Discover(fSys filesys.FileSystem, root string, opts Options) ([]string, error) {
+	var found []string
+	var err error
+	switch opts.Mode {
+	case ModeKustomize, "":
+		found, err = kustomizationRoots(fSys, root)
+	case ModeFlux:
+		found, err = fluxEntrypoints(fSys, root)
+	default:
+		return nil, fmt.Errorf("unsupported discovery mode '%s'", opts.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, p := range found {
+		ok, err := opts.matches(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (o Options) matches(path string) (bool, error) {
+	included := len(o.Include) == 0
+	for _, pattern := range o.Include {
+		ok, err := zglob.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("invalid include pattern '%s': %w", pattern, err)
+		}
+		if ok {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false, nil
+	}
+	for _, pattern := range o.Exclude {
+		ok, err := zglob.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("invalid exclude pattern '%s': %w", pattern, err)
+		}
+		if ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// HasKustomization reports whether dir contains a kustomization file
+func HasKustomization(fSys filesys.FileSystem, dir string) bool {
+	return kustomizationFile(fSys, dir) != ""
+}
+
+func kustomizationFile(fSys filesys.FileSystem, dir string) string {
+	for _, kf := range konfig.RecognizedKustomizationFileNames() {
+		p := filepath.Join(dir, kf)
+		if fSys.Exists(p) && !fSys.IsDir(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+func walkDirs(fSys filesys.FileSystem, root string, fn func(dir string) error) error {
+	return fSys.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return fn(path)
+	})
+}
+
+func kustomizationRoots(fSys filesys.FileSystem, root string) ([]string, error) {
+	dirs := map[string]bool{}
+	referenced := map[string]bool{}
+	err := walkDirs(fSys, root, func(dir string) error {
+		kf := kustomizationFile(fSys, dir)
+		if kf == "" {
+			return nil
+		}
+		dirs[filepath.Clean(dir)] = true
+		content, err := fSys.ReadFile(kf)
+		if err != nil {
+			return err
+		}
+		var k kustypes.Kustomization
+		if err := yaml.Unmarshal(content, &k); err != nil {
+			return fmt.Errorf("error parsing %s: %w", kf, err)
+		}
+		refs := append(append(append([]string{}, k.Resources...), k.Bases...), k.Components...)
+		for _, ref := range refs {
+			if filepath.IsAbs(ref) || strings.Contains(ref, "://") {
+				continue
+			}
+			referenced[filepath.Join(dir, ref)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []string
+	for dir := range dirs {
+		if referenced[dir] {
+			continue
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, rel)
+	}
+	return roots, nil
+}
+
+func fluxEntrypoints(fSys filesys.FileSystem, root string) ([]string, error) {
+	var entrypoints []string
+	err := walkDirs(fSys, root, func(dir string) error {
+		if !fSys.Exists(filepath.Join(dir, "flux-system", "gotk-sync.yaml")) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		entrypoints = append(entrypoints, rel)
+		return filepath.SkipDir
+	})
+	return entrypoints, err
+}
@@ -0,0 +1,63 @@
+package discover_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tobiash/flux-helm-preview/pkg/discover"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func testFs(t *testing.T) filesys.FileSystem {
+	fs := filesys.MakeFsInMemory()
+	files := map[string]string{
+		"/repo/apps/base/kustomization.yaml":                 "resources: [cm.yaml]\n",
+		"/repo/apps/prod/kustomization.yaml":                 "resources: [../base]\n",
+		"/repo/apps/staging/kustomization.yaml":              "resources: [../base]\n",
+		"/repo/infra/kustomization.yaml":                     "resources: [ns.yaml]\n",
+		"/repo/clusters/prod/flux-system/gotk-sync.yaml":     "",
+		"/repo/clusters/prod/flux-system/kustomization.yaml": "resources: [gotk-sync.yaml]\n",
+		"/repo/.git/kustomization.yaml":                      "",
+	}
+	for p, c := range files {
+		if err := fs.WriteFile(p, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name string
+		opts discover.Options
+		want []string
+	}{
+		{
+			name: "kustomize roots",
+			opts: discover.Options{Mode: discover.ModeKustomize},
+			want: []string{"apps/prod", "apps/staging", "clusters/prod/flux-system", "infra"},
+		},
+		{
+			name: "include and exclude",
+			opts: discover.Options{Mode: discover.ModeKustomize, Include: []string{"apps/**"}, Exclude: []string{"**/staging"}},
+			want: []string{"apps/prod"},
+		},
+		{
+			name: "flux entrypoints",
+			opts: discover.Options{Mode: discover.ModeFlux},
+			want: []string{"clusters/prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := discover.Discover(testFs(t), "/repo", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package fluxkustomize
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/fluxcd/pkg/apis/kustomize"
+	"github.com/fluxcd/pkg/apis/meta"
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	kustypes "sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+const Group = "kustomize.toolkit.fluxcd.io"
+
+// Kustomization is the subset of a Flux Kustomization needed to render it
+type Kustomization struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              KustomizationSpec `json:"spec,omitempty"`
+}
+
+type KustomizationSpec struct {
+	DependsOn       []meta.NamespacedObjectReference `json:"dependsOn,omitempty"`
+	Path            string                           `json:"path,omitempty"`
+	SourceRef       SourceReference                  `json:"sourceRef"`
+	Prune           bool                             `json:"prune"`
+	TargetNamespace string                           `json:"targetNamespace,omitempty"`
+	Patches         []kustomize.Patch                `json:"patches,omitempty"`
+	Images          []kustomize.Image                `json:"images,omitempty"`
+	PostBuild       *PostBuild                       `json:"postBuild,omitempty"`
+}
+
+type SourceReference struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type PostBuild struct {
+	Substitute     map[string]string     `json:"substitute,omitempty"`
+	SubstituteFrom []SubstituteReference `json:"substituteFrom,omitempty"`
+}
+
+type SubstituteReference struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// IsKustomization reports whether res is a Flux Kustomization
+func IsKustomization(res *resource.Resource) bool {
+	gvk := res.GetGvk()
+	return gvk.Group == Group && gvk.Kind == "Kustomization"
+}
+
+// Parse converts a resource into a Flux Kustomization
+func Parse(res *resource.Resource) (*Kustomization, error) {
+	m, err := res.Map()
+	if err != nil {
+		return nil, err
+	}
+	var ks Kustomization
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, &ks); err != nil {
+		return nil, fmt.Errorf("error converting Kustomization %s/%s: %w", res.GetNamespace(), res.GetName(), err)
+	}
+	return &ks, nil
+}
+
+// Source returns the reference of the source the Kustomization is built from
+func (k *Kustomization) Source() sources.Ref {
+	ns := k.Spec.SourceRef.Namespace
+	if ns == "" {
+		ns = k.Namespace
+	}
+	return sources.Ref{Kind: k.Spec.SourceRef.Kind, Namespace: ns, Name: k.Spec.SourceRef.Name}
+}
+
+// RenderAll renders all Flux Kustomizations found in r, including those produced by other
+// Kustomizations, and adds the resulting objects to r
+func RenderAll(r *render.Render, resolver *sources.Resolver, log logr.Logger) error {
+	_, err := renderAll(r, resolver, log, false)
+	return err
+}
+
+// RenderAllPartial renders like RenderAll, but skips Kustomizations which fail to render and
+// returns their failures
+func RenderAllPartial(r *render.Render, resolver *sources.Resolver, log logr.Logger) ([]render.Failure, error) {
+	return renderAll(r, resolver, log, true)
+}
+
+func renderAll(r *render.Render, resolver *sources.Resolver, log logr.Logger, partial bool) ([]render.Failure, error) {
+	var failures []render.Failure
+	rendered := map[string]bool{}
+	for {
+		var pending []*Kustomization
+		for _, res := range r.Resources() {
+			if !IsKustomization(res) {
+				continue
+			}
+			key := res.GetNamespace() + "/" + res.GetName()
+			if rendered[key] {
+				continue
+			}
+			rendered[key] = true
+			ks, err := Parse(res)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, ks)
+		}
+		if len(pending) == 0 {
+			return failures, nil
+		}
+		for _, ks := range pending {
+			log.Info("rendering flux kustomization", "name", ks.Name, "namespace", ks.Namespace, "path", ks.Spec.Path)
+			rm, err := renderKustomization(r, ks, resolver, log)
+			if err != nil && partial {
+				log.Error(err, "skipping flux kustomization", "name", ks.Name, "namespace", ks.Namespace)
+				failures = append(failures, render.Failure{
+					Kind:      "Kustomization",
+					Namespace: ks.Namespace,
+					Name:      ks.Name,
+					Labels:    originLabels(ks.Name, ks.Namespace),
+					Err:       err,
+				})
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error rendering Kustomization %s/%s: %w", ks.Namespace, ks.Name, err)
+			}
+			if err := merge(r, rm); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// merge adds the objects of rm to r. Objects that are already part of r, e.g. because the
+// Kustomization reconciles the path under preview itself, are replaced by their rendered version.
+func merge(r *render.Render, rm resmap.ResMap) error {
+	for _, res := range rm.Resources() {
+		if _, err := r.GetByCurrentId(res.CurId()); err == nil {
+			if _, err := r.Replace(res); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := r.Append(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderKustomization(r *render.Render, ks *Kustomization, resolver *sources.Resolver, log logr.Logger) (resmap.ResMap, error) {
+	loc, err := resolver.Resolve(ks.Source())
+	if err != nil {
+		return nil, err
+	}
+	sub := render.NewDefaultRender(log.WithValues("kustomization", ks.Name))
+	if err := sub.AddKustomization(loc.FS, filepath.Join(loc.Path, ks.Spec.Path)); err != nil {
+		return nil, err
+	}
+
+	rm, err := customize(ks, sub.ResMap)
+	if err != nil {
+		return nil, err
+	}
+	if err := substitute(r, ks, rm); err != nil {
+		return nil, err
+	}
+	for _, res := range rm.Resources() {
+		labels := res.GetLabels()
+		for k, v := range originLabels(ks.Name, ks.Namespace) {
+			labels[k] = v
+		}
+		if err := res.SetLabels(labels); err != nil {
+			return nil, err
+		}
+	}
+	return rm, nil
+}
+
+func originLabels(name, namespace string) map[string]string {
+	return map[string]string{
+		fmt.Sprintf("%s/name", Group):      name,
+		fmt.Sprintf("%s/namespace", Group): namespace,
+	}
+}
+
+// customize applies the targetNamespace, images and patches of the Kustomization to the
+// rendered objects, like kustomize-controller does by amending the kustomization file
+func customize(ks *Kustomization, rm resmap.ResMap) (resmap.ResMap, error) {
+	if ks.Spec.TargetNamespace == "" && len(ks.Spec.Images) == 0 && len(ks.Spec.Patches) == 0 {
+		return rm, nil
+	}
+	content, err := rm.AsYaml()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := kustypes.Kustomization{}
+	cfg.APIVersion = kustypes.KustomizationVersion
+	cfg.Kind = kustypes.KustomizationKind
+	cfg.Namespace = ks.Spec.TargetNamespace
+
+	const input = "resources.yaml"
+	cfg.Resources = []string{input}
+	for _, image := range ks.Spec.Images {
+		cfg.Images = append(cfg.Images, kustypes.Image{
+			Name:    image.Name,
+			NewName: image.NewName,
+			NewTag:  image.NewTag,
+			Digest:  image.Digest,
+		})
+	}
+	for _, p := range ks.Spec.Patches {
+		target := &kustypes.Selector{
+			AnnotationSelector: p.Target.AnnotationSelector,
+			LabelSelector:      p.Target.LabelSelector,
+		}
+		target.Gvk.Group = p.Target.Group
+		target.Gvk.Version = p.Target.Version
+		target.Gvk.Kind = p.Target.Kind
+		target.Name = p.Target.Name
+		target.Namespace = p.Target.Namespace
+		cfg.Patches = append(cfg.Patches, kustypes.Patch{
+			Patch:  p.Patch,
+			Target: target,
+		})
+	}
+
+	kustomization, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile(filepath.Join("/", input), content); err != nil {
+		return nil, err
+	}
+	if err := fs.WriteFile("/kustomization.yaml", kustomization); err != nil {
+		return nil, err
+	}
+	return krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fs, "/")
+}
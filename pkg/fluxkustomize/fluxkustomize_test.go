@@ -0,0 +1,239 @@
+package fluxkustomize_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/fluxkustomize"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+)
+
+const apps = `apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
+kind: Kustomization
+metadata:
+  name: apps
+  namespace: flux-system
+spec:
+  path: ./apps
+  prune: true
+  sourceRef:
+    kind: GitRepository
+    name: flux-system
+  targetNamespace: prod
+  images:
+  - name: nginx
+    newTag: "1.25"
+  patches:
+  - target:
+      kind: Deployment
+    patch: |
+      - op: add
+        path: /spec/replicas
+        value: 3
+  postBuild:
+    substitute:
+      env: prod
+    substituteFrom:
+    - kind: ConfigMap
+      name: vars
+    - kind: Secret
+      name: creds
+    - kind: ConfigMap
+      name: absent
+      optional: true
+`
+
+func testRepo(t *testing.T, clusters ...string) filesys.FileSystem {
+	fs := filesys.MakeFsInMemory()
+	files := map[string]string{
+		"/repo/clusters/ks.yaml": strings.Join(clusters, "---\n"),
+		"/repo/clusters/vars.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: vars
+  namespace: flux-system
+data:
+  size: large
+  env: overridden
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+  namespace: flux-system
+data:
+  password: czNjcmV0
+`,
+		"/repo/apps/kustomization.yaml": "resources: [deploy.yaml, cm.yaml, nested.yaml]\n",
+		"/repo/apps/deploy.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.21
+`,
+		"/repo/apps/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  env: ${env}
+  size: ${size}
+  password: ${password}
+  region: ${region:=eu}
+  zone: ${zone:-a}
+  greeting: hello ${unset}world
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: verbatim
+  annotations:
+    kustomize.toolkit.fluxcd.io/substitute: disabled
+data:
+  env: ${env}
+`,
+		"/repo/apps/nested.yaml": `apiVersion: kustomize.toolkit.fluxcd.io/v1beta2
+kind: Kustomization
+metadata:
+  name: nested
+  namespace: flux-system
+spec:
+  path: ./nested
+  sourceRef:
+    kind: GitRepository
+    name: flux-system
+    namespace: flux-system
+`,
+		"/repo/nested/cm.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: nested\n  namespace: default\n",
+	}
+	for p, c := range files {
+		if err := fs.WriteFile(p, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+func renderRepo(t *testing.T, fs filesys.FileSystem, partial bool) (*render.Render, []render.Failure, error) {
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, "/repo/clusters"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sources.New(sources.Config{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := m.WithSelf(sources.Location{FS: fs, Path: "/repo"})
+	if partial {
+		failures, err := fluxkustomize.RenderAllPartial(r, resolver, logr.Discard())
+		return r, failures, err
+	}
+	return r, nil, fluxkustomize.RenderAll(r, resolver, logr.Discard())
+}
+
+func TestRenderAll(t *testing.T) {
+	r, _, err := renderRepo(t, testRepo(t, apps), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMap, deployment := resid.NewGvk("", "v1", "ConfigMap"), resid.NewGvk("apps", "v1", "Deployment")
+	get := func(gvk resid.Gvk, name, namespace string) map[string]interface{} {
+		t.Helper()
+		res, err := r.GetById(resid.NewResIdWithNamespace(gvk, name, namespace))
+		if err != nil {
+			t.Fatalf("expected %s %s/%s to be rendered: %v", gvk.Kind, namespace, name, err)
+		}
+		if res.GetLabels()["kustomize.toolkit.fluxcd.io/name"] == "" {
+			t.Errorf("expected origin labels on %s %s/%s, got %v", gvk.Kind, namespace, name, res.GetLabels())
+		}
+		m, err := res.Map()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	settings := get(configMap, "settings", "prod")["data"].(map[string]interface{})
+	tests := []struct {
+		key, want string
+	}{
+		{"env", "prod"},
+		{"size", "large"},
+		{"password", "s3cret"},
+		{"region", "eu"},
+		{"zone", "a"},
+		{"greeting", "hello world"},
+	}
+	for _, tt := range tests {
+		if got := settings[tt.key]; got != tt.want {
+			t.Errorf("%s: got %v, want %q", tt.key, got, tt.want)
+		}
+	}
+	if got := get(configMap, "verbatim", "prod")["data"].(map[string]interface{})["env"]; got != "${env}" {
+		t.Errorf("expected substitution to be disabled, got %v", got)
+	}
+
+	deploy := get(deployment, "web", "prod")
+	spec := deploy["spec"].(map[string]interface{})
+	if spec["replicas"] != int64(3) && spec["replicas"] != 3 {
+		t.Errorf("expected patch to set replicas, got %v", spec["replicas"])
+	}
+	containers := spec["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})
+	if image := containers[0].(map[string]interface{})["image"]; image != "nginx:1.25" {
+		t.Errorf("expected image override, got %v", image)
+	}
+
+	get(configMap, "nested", "default")
+}
+
+func TestRenderAllErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		ks      string
+		wantErr string
+	}{
+		{
+			name:    "missing substituteFrom",
+			ks:      strings.Replace(apps, "name: absent\n      optional: true\n", "name: absent\n", 1),
+			wantErr: "ConfigMap 'flux-system/absent' referenced by substituteFrom not found",
+		},
+		{
+			name:    "unmapped source",
+			ks:      strings.Replace(apps, "name: flux-system\n", "name: platform\n", 1),
+			wantErr: "GitRepository/flux-system/platform",
+		},
+		{
+			name:    "missing path",
+			ks:      strings.Replace(apps, "path: ./apps", "path: ./absent", 1),
+			wantErr: "Kustomization flux-system/apps",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := testRepo(t, tt.ks)
+			if _, _, err := renderRepo(t, fs, false); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+
+			r, failures, err := renderRepo(t, fs, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(failures) != 1 || failures[0].Name != "apps" || failures[0].Labels["kustomize.toolkit.fluxcd.io/name"] != "apps" {
+				t.Errorf("expected apps to fail, got %v", failures)
+			}
+			if r.Size() != 3 {
+				t.Errorf("expected only the cluster objects to be rendered, got %d", r.Size())
+			}
+		})
+	}
+}
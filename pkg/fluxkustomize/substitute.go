@@ -0,0 +1,119 @@
+package fluxkustomize
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const substituteAnnotation = Group + "/substitute"
+
+var SECRET_GVK = resid.NewGvk("", "v1", "Secret")
+var CONFIGMAP_GVK = resid.NewGvk("", "v1", "ConfigMap")
+
+// varPattern matches ${var}, ${var:=default} and ${var:-default}
+var varPattern = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)(?::?[=-]([^}]*))?\}`)
+
+// substitute applies the post build variable substitutions of the Kustomization to rm
+func substitute(r *render.Render, ks *Kustomization, rm resmap.ResMap) error {
+	if ks.Spec.PostBuild == nil {
+		return nil
+	}
+	vars := map[string]string{}
+	for _, ref := range ks.Spec.PostBuild.SubstituteFrom {
+		data, err := substituteData(r, ks.Namespace, ref)
+		if err != nil {
+			return err
+		}
+		for k, v := range data {
+			vars[k] = v
+		}
+	}
+	for k, v := range ks.Spec.PostBuild.Substitute {
+		vars[k] = v
+	}
+
+	for _, res := range rm.Resources() {
+		if res.GetLabels()[substituteAnnotation] == "disabled" || res.GetAnnotations()[substituteAnnotation] == "disabled" {
+			continue
+		}
+		content, err := res.AsYAML()
+		if err != nil {
+			return err
+		}
+		substituted := varPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+			groups := varPattern.FindSubmatch(match)
+			if v, ok := vars[string(groups[1])]; ok {
+				return []byte(v)
+			}
+			return groups[2]
+		})
+		node, err := yaml.Parse(string(substituted))
+		if err != nil {
+			return fmt.Errorf("error substituting variables in %s: %w", res.CurId(), err)
+		}
+		res.SetYNode(node.YNode())
+	}
+	return nil
+}
+
+func substituteData(r *render.Render, namespace string, ref SubstituteReference) (map[string]string, error) {
+	var gvk resid.Gvk
+	switch ref.Kind {
+	case "ConfigMap":
+		gvk = CONFIGMAP_GVK
+	case "Secret":
+		gvk = SECRET_GVK
+	default:
+		return nil, fmt.Errorf("unsupported substituteFrom kind '%s'", ref.Kind)
+	}
+	res, err := r.Lookup(resid.NewResIdWithNamespace(gvk, ref.Name, namespace))
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		if ref.Optional {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s '%s/%s' referenced by substituteFrom not found", ref.Kind, namespace, ref.Name)
+	}
+
+	result := map[string]string{}
+	switch ref.Kind {
+	case "ConfigMap":
+		var cm corev1.ConfigMap
+		if err := convert(res, &cm); err != nil {
+			return nil, err
+		}
+		for k, v := range cm.Data {
+			result[k] = v
+		}
+	case "Secret":
+		var secret corev1.Secret
+		if err := convert(res, &secret); err != nil {
+			return nil, err
+		}
+		for k, v := range secret.StringData {
+			result[k] = v
+		}
+		for k, v := range secret.Data {
+			result[k] = string(v)
+		}
+	}
+	return result, nil
+}
+
+func convert(from *resource.Resource, to interface{}) error {
+	m, err := from.Map()
+	if err != nil {
+		return err
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(m, to)
+}
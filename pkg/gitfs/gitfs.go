@@ -0,0 +1,120 @@
+package gitfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// Root is the path of the repository root within file systems returned by New
+const Root = "/"
+
+type entry struct {
+	object string
+	path   string
+}
+
+// New reads the tree of ref in the git repository at repo into an in-memory file system.
+// Symlinks and submodules are skipped and logged, files which the in-memory file system cannot
+// store are an error.
+func New(repo, ref string, log logr.Logger) (filesys.FileSystem, error) {
+	tree, err := git(repo, nil, "rev-parse", "--verify", "--quiet", ref+"^{tree}")
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve git ref '%s': %w", ref, err)
+	}
+	list, err := git(repo, nil, "ls-tree", "-r", "-z", "--full-tree", strings.TrimSpace(string(tree)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tree of '%s': %w", ref, err)
+	}
+
+	var entries []entry
+	var objects bytes.Buffer
+	for _, line := range strings.Split(string(list), "\x00") {
+		if line == "" {
+			continue
+		}
+		// <mode> SP <type> SP <object> TAB <file>
+		meta, file, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("unexpected ls-tree output '%s'", line)
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected ls-tree output '%s'", line)
+		}
+		switch {
+		case fields[1] == "commit":
+			log.Info("skipping submodule", "ref", ref, "path", file)
+			continue
+		case fields[0] == "120000":
+			log.Info("skipping symlink", "ref", ref, "path", file)
+			continue
+		case fields[1] != "blob":
+			continue
+		}
+		entries = append(entries, entry{object: fields[2], path: file})
+		fmt.Fprintln(&objects, fields[2])
+	}
+
+	blobs, err := git(repo, &objects, "cat-file", "--batch")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read objects of '%s': %w", ref, err)
+	}
+
+	fs := filesys.MakeFsInMemory()
+	r := bufio.NewReader(bytes.NewReader(blobs))
+	for _, e := range entries {
+		content, err := readBlob(r, e.object)
+		if err != nil {
+			return nil, err
+		}
+		if err := fs.WriteFile(path.Join(Root, e.path), content); err != nil {
+			return nil, fmt.Errorf("error reading %s at %s: %w", e.path, ref, err)
+		}
+	}
+	return fs, nil
+}
+
+// readBlob reads a single object from git cat-file --batch output
+func readBlob(r *bufio.Reader, object string) ([]byte, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading object %s: %w", object, err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[0] != object {
+		return nil, fmt.Errorf("unexpected cat-file output '%s'", strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected object size '%s': %w", fields[2], err)
+	}
+	content := make([]byte, size+1)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, fmt.Errorf("error reading object %s: %w", object, err)
+	}
+	return content[:size], nil
+}
+
+func git(repo string, stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", repo}, args...)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,115 @@
+package gitfs_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/tobiash/flux-helm-preview/pkg/gitfs"
+)
+
+// gitRepo creates a repository with three commits. The second commit changes a manifest, adds a
+// symlink and a submodule. The third adds a file with whitespace in its name, which the in-memory
+// file system does not support.
+func gitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q")
+	write("app/kustomization.yaml", "resources: [cm.yaml]\n")
+	write("app/cm.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: a\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "first")
+
+	write("app/cm.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: b\n")
+	write("empty.yaml", "")
+	if err := os.Symlink("cm.yaml", filepath.Join(dir, "app/link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	run("add", "-A")
+	run("update-index", "--add", "--cacheinfo", "160000,0123456789abcdef0123456789abcdef01234567,vendor/module")
+	run("commit", "-q", "-m", "second")
+
+	write("app/with space\tand tab.yaml", "no trailing newline")
+	run("add", "-A")
+	run("commit", "-q", "-m", "third")
+	return dir
+}
+
+func TestNew(t *testing.T) {
+	dir := gitRepo(t)
+
+	first, err := gitfs.New(dir, "HEAD~2", logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var skipped []string
+	log := funcr.New(func(prefix, args string) { skipped = append(skipped, args) }, funcr.Options{})
+	second, err := gitfs.New(dir, "HEAD~1", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path        string
+		first, want string
+	}{
+		{path: "/app/kustomization.yaml", first: "resources: [cm.yaml]\n", want: "resources: [cm.yaml]\n"},
+		{path: "/app/cm.yaml", first: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: a\n", want: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: b\n"},
+		{path: "/empty.yaml", want: ""},
+	}
+	for _, tt := range tests {
+		got, err := second.ReadFile(tt.path)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s at HEAD~1: got %q (%v), want %q", tt.path, got, err, tt.want)
+		}
+		if tt.first == "" {
+			if first.Exists(tt.path) {
+				t.Errorf("%s should not exist at HEAD~2", tt.path)
+			}
+			continue
+		}
+		if got, err := first.ReadFile(tt.path); err != nil || string(got) != tt.first {
+			t.Errorf("%s at HEAD~2: got %q (%v), want %q", tt.path, got, err, tt.first)
+		}
+	}
+
+	for _, p := range []string{"/app/link.yaml", "/vendor/module"} {
+		if second.Exists(p) {
+			t.Errorf("expected %s to be skipped", p)
+		}
+	}
+	if got := strings.Join(skipped, "\n"); !strings.Contains(got, `"skipping symlink"`) || !strings.Contains(got, `"app/link.yaml"`) ||
+		!strings.Contains(got, `"skipping submodule"`) || !strings.Contains(got, `"vendor/module"`) {
+		t.Errorf("expected the skipped entries to be logged, got:\n%s", got)
+	}
+
+	if _, err := gitfs.New(dir, "HEAD", logr.Discard()); err == nil || !strings.Contains(err.Error(), "error reading app/with space\tand tab.yaml at HEAD") {
+		t.Errorf("expected an error for a file which cannot be stored, got %v", err)
+	}
+
+	if _, err := gitfs.New(dir, "does-not-exist", logr.Discard()); err == nil || !strings.Contains(err.Error(), "does-not-exist") {
+		t.Errorf("expected an error for an unknown ref, got %v", err)
+	}
+}
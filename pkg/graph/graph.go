@@ -0,0 +1,302 @@
+package graph
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+const (
+	FormatDOT     = "dot"
+	FormatMermaid = "mermaid"
+)
+
+var Formats = []string{FormatDOT, FormatMermaid}
+
+// kinds maps the API groups of objects with spec.dependsOn to the kind they may depend on
+var kinds = map[string]string{
+	"kustomize.toolkit.fluxcd.io": "Kustomization",
+	"helm.toolkit.fluxcd.io":      "HelmRelease",
+}
+
+// Node identifies a Flux object within a rendered unit
+type Node struct {
+	Unit      string
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (n Node) String() string {
+	return fmt.Sprintf("%s %s/%s", n.Kind, n.Namespace, n.Name)
+}
+
+func (n Node) key() string {
+	return n.Unit + "\x00" + n.String()
+}
+
+// label is unique across units
+func (n Node) label() string {
+	if n.Unit == "" {
+		return n.String()
+	}
+	return n.Unit + ": " + n.String()
+}
+
+// Graph is the dependency graph of Flux Kustomizations and HelmReleases
+type Graph struct {
+	nodes map[string]Node
+	deps  map[string][]Node
+}
+
+func New() *Graph {
+	return &Graph{
+		nodes: map[string]Node{},
+		deps:  map[string][]Node{},
+	}
+}
+
+// Add adds all Kustomizations and HelmReleases of a rendered unit to the graph
+func (g *Graph) Add(unit string, r *render.Render) error {
+	for _, res := range r.Resources() {
+		kind, ok := kinds[res.GetGvk().Group]
+		if !ok || res.GetKind() != kind {
+			continue
+		}
+		n := Node{Unit: unit, Kind: kind, Namespace: res.GetNamespace(), Name: res.GetName()}
+		deps, err := dependsOn(res)
+		if err != nil {
+			return fmt.Errorf("error reading dependencies of %s: %w", n, err)
+		}
+		g.nodes[n.key()] = n
+		for _, d := range deps {
+			if d.Namespace == "" {
+				d.Namespace = n.Namespace
+			}
+			g.deps[n.key()] = append(g.deps[n.key()], Node{Unit: unit, Kind: kind, Namespace: d.Namespace, Name: d.Name})
+		}
+	}
+	return nil
+}
+
+type reference struct {
+	Name      string
+	Namespace string
+}
+
+func dependsOn(res *resource.Resource) ([]reference, error) {
+	m, err := res.Map()
+	if err != nil {
+		return nil, err
+	}
+	spec, _ := m["spec"].(map[string]interface{})
+	list, _ := spec["dependsOn"].([]interface{})
+	var refs []reference
+	for _, item := range list {
+		d, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid dependsOn entry %v", item)
+		}
+		name, _ := d["name"].(string)
+		namespace, _ := d["namespace"].(string)
+		refs = append(refs, reference{Name: name, Namespace: namespace})
+	}
+	return refs, nil
+}
+
+// ValidationError lists missing and cyclic dependencies
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid dependencies: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate returns a ValidationError if a dependency is missing or dependencies form a cycle
+func (g *Graph) Validate() error {
+	if problems := g.Problems(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Problems lists missing and cyclic dependencies
+func (g *Graph) Problems() []string {
+	var problems []string
+	for _, k := range g.keys() {
+		for _, d := range g.deps[k] {
+			if _, ok := g.nodes[d.key()]; !ok {
+				problems = append(problems, fmt.Sprintf("%s depends on missing %s", g.nodes[k], d))
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var stack []string
+	var visit func(k string)
+	visit = func(k string) {
+		switch state[k] {
+		case done:
+			return
+		case visiting:
+			var cycle []string
+			for i := len(stack) - 1; i >= 0; i-- {
+				cycle = append([]string{g.nodes[stack[i]].String()}, cycle...)
+				if stack[i] == k {
+					break
+				}
+			}
+			cycle = append(cycle, g.nodes[k].String())
+			problems = append(problems, fmt.Sprintf("dependency cycle %s", strings.Join(cycle, " -> ")))
+			return
+		}
+		state[k] = visiting
+		stack = append(stack, k)
+		for _, d := range g.deps[k] {
+			if _, ok := g.nodes[d.key()]; ok {
+				visit(d.key())
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[k] = done
+	}
+	for _, k := range g.keys() {
+		visit(k)
+	}
+	return problems
+}
+
+func (g *Graph) keys() []string {
+	keys := make([]string, 0, len(g.nodes))
+	for k := range g.nodes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// missing returns the dependencies which are not part of the graph, in a stable order
+func (g *Graph) missing() []Node {
+	seen := map[string]bool{}
+	var result []Node
+	for _, k := range g.keys() {
+		for _, d := range g.deps[k] {
+			if _, ok := g.nodes[d.key()]; !ok && !seen[d.key()] {
+				seen[d.key()] = true
+				result = append(result, d)
+			}
+		}
+	}
+	return result
+}
+
+// units returns the node keys grouped by unit, in a stable order
+func (g *Graph) units() ([]string, map[string][]string) {
+	var units []string
+	byUnit := map[string][]string{}
+	for _, k := range g.keys() {
+		u := g.nodes[k].Unit
+		if _, ok := byUnit[u]; !ok {
+			units = append(units, u)
+		}
+		byUnit[u] = append(byUnit[u], k)
+	}
+	return units, byUnit
+}
+
+// Write renders the graph in the given format. Edges point from a dependency to its
+// dependents, i.e. in reconciliation order.
+func (g *Graph) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatDOT:
+		return g.writeDOT(w)
+	case FormatMermaid:
+		return g.writeMermaid(w)
+	default:
+		return fmt.Errorf("unsupported graph format '%s'", format)
+	}
+}
+
+func (g *Graph) writeDOT(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString("digraph dependencies {\n")
+	units, byUnit := g.units()
+	for i, u := range units {
+		indent := "  "
+		if u != "" {
+			fmt.Fprintf(&b, "  subgraph cluster_%d {\n    label=%q;\n", i, u)
+			indent = "    "
+		}
+		for _, k := range byUnit[u] {
+			fmt.Fprintf(&b, "%s%q;\n", indent, g.nodes[k].label())
+		}
+		if u != "" {
+			b.WriteString("  }\n")
+		}
+	}
+	for _, d := range g.missing() {
+		fmt.Fprintf(&b, "  %q [label=%q, style=dashed];\n", d.label(), d.label()+" (missing)")
+	}
+	for _, k := range g.keys() {
+		for _, d := range g.deps[k] {
+			fmt.Fprintf(&b, "  %q -> %q;\n", d.label(), g.nodes[k].label())
+		}
+	}
+	b.WriteString("}\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (g *Graph) writeMermaid(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString("flowchart LR\n")
+	ids := map[string]string{}
+	id := func(k string) string {
+		if _, ok := ids[k]; !ok {
+			ids[k] = fmt.Sprintf("n%d", len(ids))
+		}
+		return ids[k]
+	}
+	units, byUnit := g.units()
+	for i, u := range units {
+		indent := "  "
+		if u != "" {
+			fmt.Fprintf(&b, "  subgraph u%d [%q]\n", i, u)
+			indent = "    "
+		}
+		for _, k := range byUnit[u] {
+			fmt.Fprintf(&b, "%s%s[%q]\n", indent, id(k), g.nodes[k].String())
+		}
+		if u != "" {
+			b.WriteString("  end\n")
+		}
+	}
+	for _, d := range g.missing() {
+		fmt.Fprintf(&b, "  %s[%q]\n", id(d.key()), d.String()+" (missing)")
+	}
+	for _, k := range g.keys() {
+		for _, d := range g.deps[k] {
+			fmt.Fprintf(&b, "  %s --> %s\n", id(d.key()), id(k))
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Equal reports whether both graphs have the same nodes and dependencies
+func (g *Graph) Equal(o *Graph) bool {
+	var a, b bytes.Buffer
+	_ = g.writeDOT(&a)
+	_ = o.writeDOT(&b)
+	return bytes.Equal(a.Bytes(), b.Bytes())
+}
@@ -0,0 +1,76 @@
+package graph_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/graph"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func kustomization(name string, deps ...string) string {
+	s := "apiVersion: kustomize.toolkit.fluxcd.io/v1beta2\nkind: Kustomization\nmetadata:\n  name: " + name + "\n  namespace: flux-system\nspec:\n  path: ./" + name + "\n"
+	if len(deps) > 0 {
+		s += "  dependsOn:\n"
+		for _, d := range deps {
+			s += "  - name: " + d + "\n"
+		}
+	}
+	return s
+}
+
+func testGraph(t *testing.T, docs ...string) *graph.Graph {
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/ks.yaml", []byte(strings.Join(docs, "---\n"))); err != nil {
+		t.Fatal(err)
+	}
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, "/repo"); err != nil {
+		t.Fatal(err)
+	}
+	g := graph.New()
+	if err := g.Add("", r); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestValidate(t *testing.T) {
+	g := testGraph(t, kustomization("infra"), kustomization("apps", "infra"))
+	if err := g.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := g.Write(&buf, graph.FormatDOT); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"Kustomization flux-system/infra" -> "Kustomization flux-system/apps"`) {
+		t.Errorf("missing edge in graph:\n%s", buf.String())
+	}
+
+	var verr *graph.ValidationError
+	g = testGraph(t, kustomization("apps", "infra"))
+	if err := g.Validate(); !errors.As(err, &verr) || !strings.Contains(err.Error(), "missing Kustomization flux-system/infra") {
+		t.Errorf("expected missing dependency, got %v", err)
+	}
+	for format, want := range map[string]string{
+		graph.FormatDOT:     `"Kustomization flux-system/infra" [label="Kustomization flux-system/infra (missing)", style=dashed];`,
+		graph.FormatMermaid: `["Kustomization flux-system/infra (missing)"]`,
+	} {
+		buf.Reset()
+		if err := g.Write(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(buf.String(), want) != 1 {
+			t.Errorf("expected the missing dependency to be marked once in %s:\n%s", format, buf.String())
+		}
+	}
+	g = testGraph(t, kustomization("a", "b"), kustomization("b", "a"))
+	if err := g.Validate(); !errors.As(err, &verr) || !strings.Contains(err.Error(), "dependency cycle") {
+		t.Errorf("expected dependency cycle, got %v", err)
+	}
+}
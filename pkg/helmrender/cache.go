@@ -0,0 +1,357 @@
+package helmrender
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/hashicorp/go-retryablehttp"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// cache is a persistent cache of chart repository indexes, OCI tags and chart archives which can
+// be shared between runs. Archives are stored by the SHA-256 of their content in blobs/, refs/
+// maps chart versions and OCI digests to them. Indexes and tags are refreshed after the TTL,
+// indexes are revalidated with their ETag.
+type cache struct {
+	dir     string
+	ttl     time.Duration
+	getters getter.Providers
+	limiter *limiter
+
+	// lock guards fresh and locks, locks serialize refreshes of the same index or tags
+	lock  sync.Mutex
+	fresh map[string]bool
+	locks map[string]*sync.Mutex
+}
+
+type indexMeta struct {
+	URL     string    `json:"url"`
+	ETag    string    `json:"etag,omitempty"`
+	Fetched time.Time `json:"fetched"`
+}
+
+type tagsMeta struct {
+	Ref     string    `json:"ref"`
+	Tags    []string  `json:"tags"`
+	Fetched time.Time `json:"fetched"`
+}
+
+func newCache(dir string, ttl time.Duration, getters getter.Providers, l *limiter) *cache {
+	return &cache{dir: dir, ttl: ttl, getters: getters, limiter: l, fresh: map[string]bool{}, locks: map[string]*sync.Mutex{}}
+}
+
+// lockPath locks path for a refresh and returns the function unlocking it. Refreshes of other
+// paths are not blocked.
+func (c *cache) lockPath(path string) func() {
+	c.lock.Lock()
+	l, ok := c.locks[path]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[path] = l
+	}
+	c.lock.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (c *cache) isFresh(path string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.fresh[path]
+}
+
+func (c *cache) setFresh(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.fresh[path] = true
+}
+
+func cacheKey(parts ...string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(parts, "\x00"))))
+}
+
+// index returns the path of the index of the chart repository, which is refreshed at most once
+// per run and only after the TTL
+func (c *cache) index(ctx context.Context, entry *repo.Entry) (string, error) {
+	key := cacheKey(entry.URL)
+	path := filepath.Join(c.dir, "index", key+".yaml")
+	metaPath := filepath.Join(c.dir, "index", key+".json")
+
+	defer c.lockPath(path)()
+	if c.isFresh(path) {
+		return path, nil
+	}
+
+	var meta indexMeta
+	if data, err := os.ReadFile(metaPath); err == nil {
+		_ = json.Unmarshal(data, &meta)
+	}
+	if _, err := os.Stat(path); err != nil {
+		meta = indexMeta{}
+	}
+	if !meta.Fetched.IsZero() && time.Since(meta.Fetched) < c.ttl {
+		c.setFresh(path)
+		return path, nil
+	}
+
+	client, err := httpClient(entry)
+	if err != nil {
+		return "", err
+	}
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(entry.URL, "/")+"/index.yaml", nil)
+	if err != nil {
+		return "", err
+	}
+	if entry.Username != "" {
+		req.SetBasicAuth(entry.Username, entry.Password)
+	}
+	if meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	resp, err := c.limiter.client(client).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching index of %s: %w", entry.URL, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+	case http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("error fetching index of %s: %w", entry.URL, err)
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return "", err
+		}
+		if _, err := repo.LoadIndexFile(path); err != nil {
+			os.Remove(path)
+			return "", fmt.Errorf("invalid index of %s: %w", entry.URL, err)
+		}
+		meta.ETag = resp.Header.Get("ETag")
+	default:
+		return "", fmt.Errorf("error fetching index of %s: %s", entry.URL, resp.Status)
+	}
+	meta.URL = entry.URL
+	meta.Fetched = time.Now()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(metaPath, data); err != nil {
+		return "", err
+	}
+	c.setFresh(path)
+	return path, nil
+}
+
+// repoChart returns the path of the archive of chart name matching version in the index at indexPath,
+// downloading it if it is not cached
+func (c *cache) repoChart(ctx context.Context, entry *repo.Entry, indexPath, name, version string) (string, error) {
+	index, err := repo.LoadIndexFile(indexPath)
+	if err != nil {
+		return "", err
+	}
+	cv, err := index.Get(name, version)
+	if err != nil {
+		return "", fmt.Errorf("chart '%s' version '%s' not found in %s: %w", name, version, entry.URL, err)
+	}
+	if cv.Digest != "" {
+		if path := c.blob(cv.Digest); path != "" {
+			return path, nil
+		}
+	}
+	return c.cached(cacheKey(entry.URL, cv.Name, cv.Version), cv.Digest, func() ([]byte, error) {
+		if len(cv.URLs) == 0 {
+			return nil, fmt.Errorf("chart '%s' version '%s' has no downloadable URLs", name, cv.Version)
+		}
+		u, err := chartURL(entry.URL, cv.URLs[0])
+		if err != nil {
+			return nil, err
+		}
+		g, err := c.getters.ByScheme(u.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		var buf *bytes.Buffer
+		err = c.limiter.fetch(ctx, u.String(), func() (err error) {
+			buf, err = g.Get(u.String(),
+				getter.WithURL(entry.URL),
+				getter.WithTLSClientConfig(entry.CertFile, entry.KeyFile, entry.CAFile),
+				getter.WithInsecureSkipVerifyTLS(entry.InsecureSkipTLSverify),
+				getter.WithBasicAuth(entry.Username, entry.Password),
+				getter.WithPassCredentialsAll(entry.PassCredentialsAll),
+			)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error downloading chart '%s' version '%s': %w", name, cv.Version, err)
+		}
+		return buf.Bytes(), nil
+	})
+}
+
+// ociChart returns the path of the archive of the chart at the oci:// reference by digest, or the
+// highest version matching the constraint. The resolved version or digest is returned as well.
+func (c *cache) ociChart(ctx context.Context, client *registry.Client, ref, version, digest string) (string, string, error) {
+	ref = strings.TrimPrefix(ref, fmt.Sprintf("%s://", registry.OCIScheme))
+	pull := func(ref string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			var result *registry.PullResult
+			err := c.limiter.fetch(ctx, ref, func() (err error) {
+				result, err = client.Pull(ref)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error pulling chart '%s': %w", ref, err)
+			}
+			return result.Chart.Data, nil
+		}
+	}
+	if digest != "" {
+		path, err := c.cached(cacheKey(ref, digest), "", pull(ref+"@"+digest))
+		return path, digest, err
+	}
+
+	tags, err := c.ociTags(ctx, client, ref)
+	if err != nil {
+		return "", "", err
+	}
+	constraint, err := semver.NewConstraint("*")
+	if version != "" {
+		constraint, err = semver.NewConstraint(version)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("invalid version constraint '%s': %w", version, err)
+	}
+	for _, tag := range tags {
+		v, err := semver.NewVersion(tag)
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		path, err := c.cached(cacheKey(ref, tag), "", pull(ref+":"+strings.ReplaceAll(tag, "+", "_")))
+		return path, tag, err
+	}
+	return "", "", fmt.Errorf("chart '%s' version '%s' not found", ref, version)
+}
+
+// ociTags returns the semver tags of ref in descending order, refreshed after the TTL
+func (c *cache) ociTags(ctx context.Context, client *registry.Client, ref string) ([]string, error) {
+	path := filepath.Join(c.dir, "tags", cacheKey(ref)+".json")
+	defer c.lockPath(path)()
+	var meta tagsMeta
+	if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &meta) == nil {
+		if c.isFresh(path) || time.Since(meta.Fetched) < c.ttl {
+			c.setFresh(path)
+			return meta.Tags, nil
+		}
+	}
+	var tags []string
+	err := c.limiter.fetch(ctx, ref, func() (err error) {
+		tags, err = client.Tags(ref)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags of '%s': %w", ref, err)
+	}
+	data, err := json.Marshal(tagsMeta{Ref: ref, Tags: tags, Fetched: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return nil, err
+	}
+	c.setFresh(path)
+	return tags, nil
+}
+
+// cached returns the path of the archive stored under key, fetching and storing it if it is missing.
+// The content is verified against digest if it is set.
+func (c *cache) cached(key, digest string, fetch func() ([]byte, error)) (string, error) {
+	refPath := filepath.Join(c.dir, "refs", key)
+	if sum, err := os.ReadFile(refPath); err == nil {
+		if path := c.blob(string(sum)); path != "" {
+			return path, nil
+		}
+	}
+	data, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	if digest != "" && strings.TrimPrefix(digest, "sha256:") != sum {
+		return "", fmt.Errorf("digest mismatch, expected %s but got %s", digest, sum)
+	}
+	path := filepath.Join(c.dir, "blobs", "sha256", sum+".tgz")
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(refPath, []byte(sum))
+}
+
+// blob returns the path of the archive with the given SHA-256, or an empty string if it is not cached
+func (c *cache) blob(sum string) string {
+	path := filepath.Join(c.dir, "blobs", "sha256", strings.TrimPrefix(sum, "sha256:")+".tgz")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// chartURL resolves the URL of a chart relative to the repository like Helm does
+func chartURL(repoURL, chart string) (*url.URL, error) {
+	u, err := url.Parse(chart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart URL '%s': %w", chart, err)
+	}
+	if u.IsAbs() {
+		return u, nil
+	}
+	base, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	base.RawPath = strings.TrimSuffix(base.RawPath, "/") + "/"
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	return base.ResolveReference(u), nil
+}
+
+// httpClient returns a client with the TLS configuration of the chart repository
+func httpClient(entry *repo.Entry) (*http.Client, error) {
+	cfg := &tls.Config{InsecureSkipVerify: entry.InsecureSkipTLSverify} //nolint:gosec
+	if entry.CertFile != "" && entry.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(entry.CertFile, entry.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if entry.CAFile != "" {
+		ca, err := os.ReadFile(entry.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading CA: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("invalid CA file '%s'", entry.CAFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,200 @@
+package helmrender_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func TestCache(t *testing.T) {
+	charts := t.TempDir()
+	if _, err := chartutil.Save(testChart("1.0.0"), charts); err != nil {
+		t.Fatal(err)
+	}
+	var indexRequests, notModified, chartRequests int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/index.yaml" {
+			atomic.AddInt32(&chartRequests, 1)
+			http.ServeFile(w, req, filepath.Join(charts, filepath.Base(req.URL.Path)))
+			return
+		}
+		atomic.AddInt32(&indexRequests, 1)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		index, err := repo.IndexDirectory(charts, srv.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		path := filepath.Join(t.TempDir(), "index.yaml")
+		_ = index.WriteFile(path, 0o644)
+		data, _ := os.ReadFile(path)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+	registry, _ := testRegistry(t, "charts/demo", testChart("1.0.0"), testChart("1.2.0"))
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: https
+  namespace: default
+spec:
+  url: %s
+---
+apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: oci
+  namespace: default
+spec:
+  type: oci
+  url: oci://%s/charts
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: from-https
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      sourceRef:
+        kind: HelmRepository
+        name: https
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: from-oci
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      version: 1.x
+      sourceRef:
+        kind: HelmRepository
+        name: oci
+`, srv.URL, host))); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	render := func(ttl time.Duration) string {
+		runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+		runner.SetCache(dir, ttl)
+		out, err := renderRepoWith(t, fs, "/repo", runner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	first := render(time.Hour)
+	if indexRequests != 1 || chartRequests != 1 {
+		t.Errorf("expected one index and chart request, got %d and %d", indexRequests, chartRequests)
+	}
+
+	render(0)
+	if indexRequests != 2 || notModified != 1 || chartRequests != 1 {
+		t.Errorf("expected the index to be revalidated, got %d index requests, %d not modified and %d chart requests", indexRequests, notModified, chartRequests)
+	}
+
+	registry.Close()
+	if cached := render(time.Hour); cached != first {
+		t.Errorf("cached render differs:\n%s\n---\n%s", cached, first)
+	}
+	if indexRequests != 2 || chartRequests != 1 {
+		t.Errorf("expected no requests within the TTL, got %d index and %d chart requests", indexRequests, chartRequests)
+	}
+}
+
+func TestCacheConcurrentIndexes(t *testing.T) {
+	charts := t.TempDir()
+	if _, err := chartutil.Save(testChart("1.0.0"), charts); err != nil {
+		t.Fatal(err)
+	}
+	// each index is only served once the other one has been requested
+	requested := map[string]chan struct{}{"a": make(chan struct{}), "b": make(chan struct{})}
+	serve := func(name, other string) *httptest.Server {
+		var srv *httptest.Server
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/index.yaml" {
+				close(requested[name])
+				select {
+				case <-requested[other]:
+				case <-time.After(5 * time.Second):
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				index, err := repo.IndexDirectory(charts, srv.URL)
+				if err != nil {
+					t.Error(err)
+				}
+				path := filepath.Join(t.TempDir(), "index.yaml")
+				_ = index.WriteFile(path, 0o644)
+				http.ServeFile(w, req, path)
+				return
+			}
+			http.ServeFile(w, req, filepath.Join(charts, filepath.Base(req.URL.Path)))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+
+	var manifests []string
+	for name, other := range map[string]string{"a": "b", "b": "a"} {
+		manifests = append(manifests, fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: %[1]s
+  namespace: default
+spec:
+  url: %[2]s
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: %[1]s
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      sourceRef:
+        kind: HelmRepository
+        name: %[1]s
+`, name, serve(name, other).URL))
+	}
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(strings.Join(manifests, "---\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+	runner.SetLimits(helmrender.Limits{Retries: -1})
+	runner.SetCache(t.TempDir(), time.Hour)
+	if _, err := renderRepoWith(t, fs, "/repo", runner); err != nil {
+		t.Fatal(err)
+	}
+}
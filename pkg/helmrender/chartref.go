@@ -0,0 +1,108 @@
+package helmrender
+
+import (
+	"fmt"
+
+	v2 "github.com/fluxcd/helm-controller/api/v2beta1"
+	"helm.sh/helm/v3/pkg/registry"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// ChartReference is the spec.chartRef of v2beta2 and v2 HelmReleases, which has no v2beta1
+// equivalent
+type ChartReference struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+func chartReference(res *resource.Resource) (*ChartReference, error) {
+	m, err := res.Map()
+	if err != nil {
+		return nil, err
+	}
+	spec, _ := m["spec"].(map[string]interface{})
+	u, ok := spec["chartRef"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	var ref ChartReference
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u, &ref); err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+// setChart sets the chart to render for the HelmRelease, from either spec.chartRef or
+// spec.chart
+func (r *HelmRepo) setChart(hr *v2.HelmRelease, t *RenderTask) error {
+	owner := types.NamespacedName{Namespace: hr.Namespace, Name: hr.Name}
+	if ref, ok := r.chartRefs[owner]; ok {
+		return r.setChartRef(owner, ref, t)
+	}
+	if hr.Spec.Chart.Spec.Chart == "" {
+		return fmt.Errorf("HelmRelease %s has neither spec.chart nor spec.chartRef", owner)
+	}
+	if err := r.setChartSource(owner, hr.Spec.Chart.Spec.SourceRef, t); err != nil {
+		return err
+	}
+	t.chart = hr.Spec.Chart.Spec.Chart
+	t.version = hr.Spec.Chart.Spec.Version
+	t.valuesFiles = valuesFiles(hr.Spec.Chart.Spec.ValuesFiles, hr.Spec.Chart.Spec.ValuesFile)
+	return nil
+}
+
+func (r *HelmRepo) setChartRef(owner types.NamespacedName, ref ChartReference, t *RenderTask) error {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = owner.Namespace
+	}
+	switch ref.Kind {
+	case "OCIRepository":
+		for _, repo := range r.ociRepos {
+			if repo.Namespace != namespace || repo.Name != ref.Name {
+				continue
+			}
+			if !registry.IsOCI(repo.Spec.URL) {
+				return fmt.Errorf("OCIRepository %s/%s has invalid URL '%s'", namespace, ref.Name, repo.Spec.URL)
+			}
+			t.chart = repo.Spec.URL
+			switch {
+			case repo.Spec.Reference == nil:
+				t.tag = "latest"
+			case repo.Spec.Reference.Digest != "":
+				t.digest = repo.Spec.Reference.Digest
+			case repo.Spec.Reference.SemVer != "":
+				t.version = repo.Spec.Reference.SemVer
+			case repo.Spec.Reference.Tag != "":
+				t.tag = repo.Spec.Reference.Tag
+			default:
+				t.tag = "latest"
+			}
+			return nil
+		}
+	case "HelmChart":
+		for _, hc := range r.helmCharts {
+			if hc.Namespace != namespace || hc.Name != ref.Name {
+				continue
+			}
+			err := r.setChartSource(types.NamespacedName{Namespace: hc.Namespace, Name: hc.Name}, v2.CrossNamespaceObjectReference{
+				Kind: hc.Spec.SourceRef.Kind,
+				Name: hc.Spec.SourceRef.Name,
+			}, t)
+			if err != nil {
+				return err
+			}
+			t.chart = hc.Spec.Chart
+			t.version = hc.Spec.Version
+			t.valuesFiles = hc.GetValuesFiles()
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported chartRef kind '%s' in HelmRelease %s, expected OCIRepository or HelmChart", ref.Kind, owner)
+	}
+	return fmt.Errorf("%s %s/%s referenced by HelmRelease %s not found", ref.Kind, namespace, ref.Name, owner)
+}
@@ -0,0 +1,29 @@
+package helmrender
+
+import (
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// HELM_RELEASE_VERSIONS are the served HelmRelease API versions
+var HELM_RELEASE_VERSIONS = []string{"v2beta1", "v2beta2", "v2"}
+
+func isHelmReleaseVersion(version string) bool {
+	for _, v := range HELM_RELEASE_VERSIONS {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// asHelmReleaseV2beta1 returns res as a v2beta1 HelmRelease. Later versions are backwards
+// compatible apart from added fields, which are dropped by the conversion, and the removed
+// deprecated fields, which are not present in them.
+func asHelmReleaseV2beta1(res *resource.Resource) *resource.Resource {
+	if res.GetGvk().Version == HELM_RELEASE_GVK.Version {
+		return res
+	}
+	res = res.DeepCopy()
+	res.SetApiVersion(HELM_RELEASE_GVK.ApiVersion())
+	return res
+}
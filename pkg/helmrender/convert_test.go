@@ -0,0 +1,88 @@
+package helmrender_test
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+const releases = `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: beta1
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: podinfo
+      version: 6.x
+      sourceRef:
+        kind: HelmRepository
+        name: podinfo
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta2
+kind: HelmRelease
+metadata:
+  name: beta2
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: podinfo
+      version: 6.x
+      sourceRef:
+        kind: HelmRepository
+        name: podinfo
+  driftDetection:
+    mode: enabled
+---
+apiVersion: helm.toolkit.fluxcd.io/v2
+kind: HelmRelease
+metadata:
+  name: ga
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: podinfo
+      version: 6.x
+      sourceRef:
+        kind: HelmRepository
+        name: podinfo
+  values:
+    replicaCount: 2
+---
+apiVersion: helm.toolkit.fluxcd.io/v3alpha1
+kind: HelmRelease
+metadata:
+  name: unknown
+  namespace: default
+`
+
+func TestParseHelmReleaseVersions(t *testing.T) {
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(releases)); err != nil {
+		t.Fatal(err)
+	}
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, "/repo"); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := helmrender.ParseHelmRepo(r, nil, nil, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, hr := range repo.Releases() {
+		names = append(names, hr.Name)
+		if hr.Spec.Chart.Spec.Chart != "podinfo" || hr.Spec.Chart.Spec.Version != "6.x" {
+			t.Errorf("unexpected chart spec of %s: %+v", hr.Name, hr.Spec.Chart.Spec)
+		}
+	}
+	if len(names) != 3 || names[0] != "beta1" || names[1] != "beta2" || names[2] != "ga" {
+		t.Errorf("unexpected releases %v", names)
+	}
+}
@@ -0,0 +1,161 @@
+package helmrender
+
+import (
+	"fmt"
+
+	v2 "github.com/fluxcd/helm-controller/api/v2beta1"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"helm.sh/helm/v3/pkg/chart"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/kustomize/api/hasher"
+	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+)
+
+// chartCRDAnnotation marks CRDs from the crds/ directories of a chart until the CRD policies are
+// applied. It never appears in the output.
+const chartCRDAnnotation = "flux-helm-preview/chart-crd"
+
+// installCRDsPolicy returns the CRD policy helm-controller uses when installing hr
+func installCRDsPolicy(hr v2.HelmRelease) (v2.CRDsPolicy, error) {
+	install := hr.Spec.GetInstall()
+	policy := v2.Create
+	if install.SkipCRDs {
+		policy = v2.Skip
+	}
+	if install.CRDs != "" {
+		policy = install.CRDs
+	}
+	return policy, validateCRDsPolicy(policy)
+}
+
+func validateCRDsPolicy(policy v2.CRDsPolicy) error {
+	switch policy {
+	case v2.Skip, v2.Create, v2.CreateReplace:
+		return nil
+	}
+	return fmt.Errorf("invalid CRD policy '%s', expected Skip, Create or CreateReplace", policy)
+}
+
+// markChartCRDs marks the CRDs of ch and its dependencies in rm
+func markChartCRDs(rm resmap.ResMap, ch *chart.Chart) error {
+	names := map[string]bool{}
+	factory := resmap.NewFactory(resource.NewFactory(&hasher.Hasher{}))
+	for _, crd := range ch.CRDObjects() {
+		crds, err := factory.NewResMapFromBytes(crd.File.Data)
+		if err != nil {
+			return fmt.Errorf("error reading CRDs of chart %s: %w", ch.Name(), err)
+		}
+		for _, res := range crds.Resources() {
+			names[res.GetName()] = true
+		}
+	}
+	for _, res := range rm.Resources() {
+		if res.GetKind() == "CustomResourceDefinition" && names[res.GetName()] {
+			if err := setAnnotation(res, chartCRDAnnotation, "true"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setAnnotation(res *resource.Resource, key, value string) error {
+	annotations := res.GetAnnotations()
+	if value == "" {
+		delete(annotations, key)
+	} else {
+		annotations[key] = value
+	}
+	return res.SetAnnotations(annotations)
+}
+
+// ApplyUpgradeCRDPolicies changes the chart CRDs of b to what helm-controller leaves in the cluster
+// when upgrading from a. Releases of b which are not in a are installed, their CRDs are already
+// rendered according to the install policy. Releases are matched regardless of their apiVersion.
+func ApplyUpgradeCRDPolicies(a, b *render.Render) error {
+	for _, res := range b.Resources() {
+		gvk := res.GetGvk()
+		if gvk.Group != HELM_RELEASE_GVK.Group || gvk.Kind != HELM_RELEASE_GVK.Kind {
+			continue
+		}
+		if !hasHelmRelease(a, res) {
+			continue
+		}
+		m, err := asHelmReleaseV2beta1(res).Map()
+		if err != nil {
+			return err
+		}
+		var hr v2.HelmRelease
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, &hr); err != nil {
+			return err
+		}
+		policy := hr.Spec.GetUpgrade().CRDs
+		if policy == "" {
+			policy = v2.Skip
+		}
+		if err := validateCRDsPolicy(policy); err != nil {
+			return fmt.Errorf("HelmRelease %s/%s: %w", hr.Namespace, hr.Name, err)
+		}
+
+		crdsA := chartCRDs(a, hr)
+		crdsB := chartCRDs(b, hr)
+		for id := range crdsB {
+			_, existing := crdsA[id]
+			if policy == v2.Skip || (policy == v2.Create && existing) {
+				if err := b.Remove(id); err != nil {
+					return err
+				}
+			}
+		}
+		// Helm never deletes CRDs, existing ones are only replaced with CreateReplace
+		for id, crd := range crdsA {
+			if _, err := b.GetByCurrentId(id); err == nil {
+				continue
+			}
+			if err := b.Append(crd.DeepCopy()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasHelmRelease reports whether r contains the HelmRelease hr in any apiVersion
+func hasHelmRelease(r *render.Render, hr *resource.Resource) bool {
+	id := hr.CurId()
+	for _, res := range r.Resources() {
+		other := res.CurId()
+		if other.Group == id.Group && other.Kind == id.Kind && other.Namespace == id.Namespace && other.Name == id.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func chartCRDs(r *render.Render, hr v2.HelmRelease) map[resid.ResId]*resource.Resource {
+	result := map[resid.ResId]*resource.Resource{}
+	for _, res := range r.Resources() {
+		labels := res.GetLabels()
+		if res.GetAnnotations()[chartCRDAnnotation] == "" ||
+			labels[v2.GroupVersion.Group+"/name"] != hr.Name ||
+			labels[v2.GroupVersion.Group+"/namespace"] != hr.Namespace {
+			continue
+		}
+		result[res.CurId()] = res
+	}
+	return result
+}
+
+// RemoveCRDMarkers removes the internal annotation of chart CRDs from r
+func RemoveCRDMarkers(r *render.Render) error {
+	for _, res := range r.Resources() {
+		if _, ok := res.GetAnnotations()[chartCRDAnnotation]; ok {
+			if err := setAnnotation(res, chartCRDAnnotation, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package helmrender_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func crd(name, version string) string {
+	return fmt.Sprintf(`apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: %[1]ss.example.com
+spec:
+  group: example.com
+  names:
+    kind: %[1]s
+    plural: %[1]ss
+  scope: Namespaced
+  versions:
+  - name: %[2]s
+    served: true
+    storage: true
+`, name, version)
+}
+
+// renderCRDChart renders a chart with the given CRDs from a HelmRelease with the given apiVersion
+// and spec
+func renderCRDChart(t *testing.T, apiVersion, spec string, crds ...string) *render.Render {
+	fs := filesys.MakeFsInMemory()
+	files := map[string]string{
+		"/clusters/prod/release.yaml": `apiVersion: ` + apiVersion + `
+kind: HelmRelease
+metadata:
+  name: app
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: ./charts/app
+      sourceRef:
+        kind: GitRepository
+        name: flux-system
+        namespace: flux-system
+` + spec,
+		"/charts/app/Chart.yaml":        "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"/charts/app/templates/cm.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n",
+		"/charts/app/crds/crds.yaml":    strings.Join(crds, "---\n"),
+	}
+	for p, c := range files {
+		if err := fs.WriteFile(p, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, "/clusters/prod"); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := sources.New(sources.Config{}, "")
+	runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+	defer runner.Close()
+	repo, err := helmrender.ParseHelmRepo(r, runner, m.WithSelf(sources.Location{FS: fs, Path: "/"}), logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := repo.RenderAllCharts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AppendAll(rm); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func crdVersions(t *testing.T, r *render.Render) string {
+	if err := helmrender.RemoveCRDMarkers(r); err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, res := range r.Resources() {
+		if res.GetKind() != "CustomResourceDefinition" {
+			continue
+		}
+		if strings.Contains(res.MustYaml(), "flux-helm-preview") {
+			t.Errorf("marker annotation left on %s", res.GetName())
+		}
+		m, _ := res.Map()
+		v := m["spec"].(map[string]interface{})["versions"].([]interface{})[0].(map[string]interface{})["name"]
+		versions = append(versions, fmt.Sprintf("%s=%s", res.GetName(), v))
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ",")
+}
+
+func TestCRDPolicies(t *testing.T) {
+	oldCRDs := []string{crd("a", "v1")}
+	newCRDs := []string{crd("a", "v2"), crd("b", "v1")}
+	tests := []struct {
+		name string
+		spec string
+		a, b string
+	}{
+		{"default", "", "as.example.com=v1", "as.example.com=v1"},
+		{"skip install", "  install:\n    crds: Skip\n", "", ""},
+		{"legacy skip install", "  install:\n    skipCRDs: true\n", "", ""},
+		{"create", "  upgrade:\n    crds: Create\n", "as.example.com=v1", "as.example.com=v1,bs.example.com=v1"},
+		{"create replace", "  upgrade:\n    crds: CreateReplace\n", "as.example.com=v1", "as.example.com=v2,bs.example.com=v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := renderCRDChart(t, "helm.toolkit.fluxcd.io/v2beta1", tt.spec, oldCRDs...)
+			b := renderCRDChart(t, "helm.toolkit.fluxcd.io/v2beta1", tt.spec, newCRDs...)
+			if err := helmrender.ApplyUpgradeCRDPolicies(a, b); err != nil {
+				t.Fatal(err)
+			}
+			if got := crdVersions(t, a); got != tt.a {
+				t.Errorf("side a: expected %q, got %q", tt.a, got)
+			}
+			if got := crdVersions(t, b); got != tt.b {
+				t.Errorf("side b: expected %q, got %q", tt.b, got)
+			}
+		})
+	}
+
+	t.Run("changed apiVersion", func(t *testing.T) {
+		// upgrading the HelmRelease from v2beta1 to v2 is no new install
+		a := renderCRDChart(t, "helm.toolkit.fluxcd.io/v2beta1", "", oldCRDs...)
+		b := renderCRDChart(t, "helm.toolkit.fluxcd.io/v2", "", newCRDs...)
+		if err := helmrender.ApplyUpgradeCRDPolicies(a, b); err != nil {
+			t.Fatal(err)
+		}
+		if got := crdVersions(t, b); got != "as.example.com=v1" {
+			t.Errorf("side b: expected the CRDs of side a to be kept, got %q", got)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package helmrender
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	source "github.com/fluxcd/source-controller/api/v1beta2"
+	"helm.sh/helm/v3/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// tlsData holds PEM encoded TLS material from Secrets, which is written to files for Helm
+type tlsData struct {
+	ca   []byte
+	cert []byte
+	key  []byte
+}
+
+// certSecretRef returns the name of spec.certSecretRef, which is newer than the source-controller API in use
+func certSecretRef(res *resource.Resource) (string, error) {
+	m, err := res.Map()
+	if err != nil {
+		return "", err
+	}
+	spec, _ := m["spec"].(map[string]interface{})
+	ref, _ := spec["certSecretRef"].(map[string]interface{})
+	name, _ := ref["name"].(string)
+	return name, nil
+}
+
+// setCredentials sets the credentials of the HelmRepository on t. Local credentials take precedence,
+// otherwise they are read from the secretRef and certSecretRef Secrets like source-controller does.
+// Missing Secrets are logged as they are often created outside of the repository.
+func (r *HelmRepo) setCredentials(hr source.HelmRepository, t *RenderTask) error {
+	t.repo.PassCredentialsAll = hr.Spec.PassCredentials
+	if c := r.credentials.For(hr.Spec.URL); c != nil {
+		t.repo.Username = c.Username
+		t.repo.Password = c.Password
+		t.repo.CAFile = c.CAFile
+		t.repo.CertFile = c.CertFile
+		t.repo.KeyFile = c.KeyFile
+		t.repo.InsecureSkipTLSverify = c.InsecureSkipTLSVerify
+		t.repo.PassCredentialsAll = t.repo.PassCredentialsAll || c.PassCredentials
+		return nil
+	}
+
+	owner := types.NamespacedName{Namespace: hr.Namespace, Name: hr.Name}
+	var tls tlsData
+	if hr.Spec.SecretRef != nil {
+		secret, err := r.credentialsSecret(owner, "secretRef", hr.Spec.SecretRef.Name)
+		if err != nil || secret == nil {
+			return err
+		}
+		t.repo.Username = string(secret.Data["username"])
+		t.repo.Password = string(secret.Data["password"])
+		if (t.repo.Username == "") != (t.repo.Password == "") {
+			return fmt.Errorf("invalid secretRef of HelmRepository %s: username and password must be set together", owner)
+		}
+		// deprecated TLS keys of secretRef
+		tls = tlsData{ca: secret.Data["caFile"], cert: secret.Data["certFile"], key: secret.Data["keyFile"]}
+	}
+	if name, ok := r.certSecrets[owner]; ok {
+		secret, err := r.credentialsSecret(owner, "certSecretRef", name)
+		if err != nil || secret == nil {
+			return err
+		}
+		tls = tlsData{ca: secret.Data["ca.crt"], cert: secret.Data["tls.crt"], key: secret.Data["tls.key"]}
+	}
+	if (len(tls.cert) == 0) != (len(tls.key) == 0) {
+		return fmt.Errorf("invalid TLS secret of HelmRepository %s: certificate and key must be set together", owner)
+	}
+	if len(tls.ca) > 0 || len(tls.cert) > 0 {
+		t.tls = &tls
+	}
+	return nil
+}
+
+func (r *HelmRepo) credentialsSecret(owner types.NamespacedName, field, name string) (*corev1.Secret, error) {
+	var secret corev1.Secret
+	namespacedName := types.NamespacedName{Namespace: owner.Namespace, Name: name}
+	found, err := r.findResource(SECRET_GVK, namespacedName, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s of HelmRepository %s: %w", field, owner, err)
+	}
+	if !found {
+		r.logger.Info("secret not found, rendering without credentials", "helmrepository", owner, field, name)
+		return nil, nil
+	}
+	for k, v := range secret.StringData {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		secret.Data[k] = []byte(v)
+	}
+	return &secret, nil
+}
+
+// writeCredentials writes the TLS material of t and, for OCI registries, a registry config with its
+// basic auth credentials to dir. It returns the path of the registry config, or an empty string.
+func (t *RenderTask) writeCredentials(dir string) (string, error) {
+	if t.tls != nil {
+		for _, f := range []struct {
+			data []byte
+			path *string
+			name string
+		}{{t.tls.ca, &t.repo.CAFile, "ca.crt"}, {t.tls.cert, &t.repo.CertFile, "tls.crt"}, {t.tls.key, &t.repo.KeyFile, "tls.key"}} {
+			if len(f.data) == 0 {
+				continue
+			}
+			*f.path = filepath.Join(dir, f.name)
+			if err := os.WriteFile(*f.path, f.data, 0o600); err != nil {
+				return "", err
+			}
+		}
+	}
+	if t.repo.Username == "" || !registry.IsOCI(t.repo.URL) {
+		return "", nil
+	}
+	host := strings.SplitN(strings.TrimPrefix(t.repo.URL, fmt.Sprintf("%s://", registry.OCIScheme)), "/", 2)[0]
+	config, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			host: map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(t.repo.Username + ":" + t.repo.Password))},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "registry.json")
+	return path, os.WriteFile(path, config, 0o600)
+}
@@ -0,0 +1,161 @@
+package helmrender_test
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobiash/flux-helm-preview/pkg/credentials"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// testChartRepository serves a chart repository which requires basic auth, over TLS if tls is set
+func testChartRepository(t *testing.T, username, password string, tls bool) *httptest.Server {
+	dir := t.TempDir()
+	if _, err := chartutil.Save(testChart("1.0.0"), dir); err != nil {
+		t.Fatal(err)
+	}
+	var srv *httptest.Server
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if u, p, ok := req.BasicAuth(); !ok || u != username || p != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path == "/index.yaml" {
+			index, err := repo.IndexDirectory(dir, srv.URL)
+			if err != nil {
+				t.Error(err)
+			}
+			_ = index.WriteFile(filepath.Join(dir, "index.yaml"), 0o644)
+		}
+		http.ServeFile(w, req, filepath.Join(dir, filepath.Base(req.URL.Path)))
+	}))
+	if tls {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	return srv
+}
+
+func TestHelmRepositoryCredentials(t *testing.T) {
+	srv := testChartRepository(t, "user", "s3cret", false)
+	defer srv.Close()
+
+	release := privateRelease(srv.URL, "  secretRef:\n    name: private-auth\n")
+	secret := func(password string) string {
+		return fmt.Sprintf("---\napiVersion: v1\nkind: Secret\nmetadata:\n  name: private-auth\n  namespace: default\nstringData:\n  username: user\n  password: %s\n", password)
+	}
+
+	tests := []struct {
+		name        string
+		manifests   string
+		credentials string
+		err         bool
+	}{
+		{"secretRef", release + secret("s3cret"), "", false},
+		{"missing secret", release, "", true},
+		{"wrong password", release + secret("wrong"), "", true},
+		{"credentials file", release + secret("wrong"), fmt.Sprintf("repositories:\n- url: %s\n  username: user\n  password: ${TEST_CHART_PASSWORD}\n", srv.URL), false},
+	}
+	t.Setenv("TEST_CHART_PASSWORD", "s3cret")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := renderPrivate(t, tt.manifests, tt.credentials)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected rendering to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, "version: 1.0.0") {
+				t.Errorf("unexpected output:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestHelmRepositoryCertSecretRef(t *testing.T) {
+	srv := testChartRepository(t, "user", "s3cret", true)
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	release := privateRelease(srv.URL, "  secretRef:\n    name: private-auth\n  certSecretRef:\n    name: private-tls\n")
+	secrets := fmt.Sprintf(`---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: private-auth
+  namespace: default
+stringData:
+  username: user
+  password: s3cret
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: private-tls
+  namespace: default
+data:
+  ca.crt: %s
+`, base64.StdEncoding.EncodeToString(ca))
+
+	out, err := renderPrivate(t, release+secrets, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "version: 1.0.0") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+	if _, err := renderPrivate(t, strings.Replace(release, "  certSecretRef:\n    name: private-tls\n", "", 1)+secrets, ""); err == nil {
+		t.Error("expected rendering without the CA to fail")
+	}
+}
+
+func privateRelease(url, auth string) string {
+	return fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: private
+  namespace: default
+spec:
+  url: %s
+%s---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: demo
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      sourceRef:
+        kind: HelmRepository
+        name: private
+`, url, auth)
+}
+
+func renderPrivate(t *testing.T, manifests, creds string) (string, error) {
+	fs := valuesFs(t, "", nil)
+	if err := fs.WriteFile("/clusters/prod/release.yaml", []byte(manifests)); err != nil {
+		t.Fatal(err)
+	}
+	c, err := credentials.Load(strings.NewReader(creds), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return renderRepo(t, fs, "/clusters/prod", testSettings(t), func(r *helmrender.HelmRepo) {
+		r.SetCredentials(c)
+	})
+}
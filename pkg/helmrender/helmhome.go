@@ -0,0 +1,90 @@
+package helmrender
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// HelmConfig points the Runner at existing Helm configuration instead of its private Helm home.
+// Empty fields keep the private location.
+type HelmConfig struct {
+	RepositoryConfig string
+	RepositoryCache  string
+	RegistryConfig   string
+}
+
+// UseHelmConfig uses the repositories file, repository cache and registry config set in c. It
+// must be called before rendering.
+func (r *Runner) UseHelmConfig(c HelmConfig) {
+	r.helmConfig = c
+}
+
+// initHome creates the private Helm home of the runner on first use and points the settings at
+// it, except for the locations set with UseHelmConfig
+func (r *Runner) initHome() error {
+	r.homeOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "flux-helm-preview-home-")
+		if err != nil {
+			r.homeErr = fmt.Errorf("error creating Helm home: %w", err)
+			return
+		}
+		r.home = dir
+		r.settings.RepositoryConfig = pick(r.helmConfig.RepositoryConfig, filepath.Join(dir, "repositories.yaml"))
+		r.settings.RepositoryCache = pick(r.helmConfig.RepositoryCache, filepath.Join(dir, "cache"))
+		r.settings.RegistryConfig = pick(r.helmConfig.RegistryConfig, filepath.Join(dir, "registry.json"))
+		if r.helmConfig.RepositoryConfig != "" {
+			// keep the repositories of an existing file when adding to it
+			if f, err := repo.LoadFile(r.helmConfig.RepositoryConfig); err == nil {
+				r.storage = *f
+			}
+		}
+	})
+	return r.homeErr
+}
+
+func pick(value, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Close removes the private Helm home. Renders abandoned after a timeout may still use it, it is
+// then removed when the last of them returns.
+func (r *Runner) Close() error {
+	r.homeLock.Lock()
+	defer r.homeLock.Unlock()
+	r.closed = true
+	if r.renders > 0 {
+		return nil
+	}
+	return r.removeHome()
+}
+
+// track counts a render using the Helm home until the returned function is called
+func (r *Runner) track() func() {
+	r.homeLock.Lock()
+	defer r.homeLock.Unlock()
+	r.renders++
+	return func() {
+		r.homeLock.Lock()
+		defer r.homeLock.Unlock()
+		r.renders--
+		if r.closed && r.renders == 0 {
+			if err := r.removeHome(); err != nil {
+				r.logger.Error(err, "error removing Helm home")
+			}
+		}
+	}
+}
+
+// removeHome must be called with homeLock held and no render running
+func (r *Runner) removeHome() error {
+	if r.home == "" {
+		return nil
+	}
+	return os.RemoveAll(r.home)
+}
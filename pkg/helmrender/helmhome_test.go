@@ -0,0 +1,70 @@
+package helmrender_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func TestHelmHome(t *testing.T) {
+	srv := testChartRepository(t, "user", "s3cret", false)
+	defer srv.Close()
+	fs := filesys.MakeFsInMemory()
+	manifests := privateRelease(srv.URL, "  secretRef:\n    name: private-auth\n") +
+		"---\napiVersion: v1\nkind: Secret\nmetadata:\n  name: private-auth\n  namespace: default\nstringData:\n  username: user\n  password: s3cret\n"
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(manifests)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("private", func(t *testing.T) {
+		settings := testSettings(t)
+		runner := helmrender.NewRunner(settings, logr.Discard())
+		if _, err := renderRepoWith(t, fs, "/repo", runner); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{settings.RepositoryConfig, settings.RegistryConfig, settings.RepositoryCache} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("expected %s not to be written", path)
+			}
+		}
+	})
+
+	t.Run("explicit", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "repositories.yaml")
+		existing := repo.NewFile()
+		existing.Add(&repo.Entry{Name: "existing", URL: "https://charts.example.com"})
+		if err := existing.WriteFile(path, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cache := filepath.Join(dir, "cache")
+		if err := os.Mkdir(cache, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.NewIndexFile().WriteFile(filepath.Join(cache, "existing-index.yaml"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+		runner.UseHelmConfig(helmrender.HelmConfig{RepositoryConfig: path, RepositoryCache: cache})
+		if _, err := renderRepoWith(t, fs, "/repo", runner); err != nil {
+			t.Fatal(err)
+		}
+		f, err := repo.LoadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.Repositories) != 2 || !f.Has("existing") {
+			t.Fatalf("expected the existing and the rendered repository, got %+v", f.Repositories)
+		}
+		for _, r := range f.Repositories {
+			if r.Password != "" {
+				t.Errorf("expected no credentials to be stored, got %+v", r)
+			}
+		}
+	})
+}
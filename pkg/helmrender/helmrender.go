@@ -9,8 +9,12 @@ import (
 	"github.com/fluxcd/pkg/runtime/transform"
 	source "github.com/fluxcd/source-controller/api/v1beta2"
 	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/capabilities"
+	"github.com/tobiash/flux-helm-preview/pkg/credentials"
 	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
 	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/repo"
 	"helm.sh/helm/v3/pkg/strvals"
 	corev1 "k8s.io/api/core/v1"
@@ -26,19 +30,35 @@ import (
 var HELM_RELEASE_GVK = resid.NewGvk("helm.toolkit.fluxcd.io", "v2beta1", "HelmRelease")
 var HELM_REPO_V1BETA1_GVK = resid.NewGvk("source.toolkit.fluxcd.io", "v1beta1", "HelmRepository")
 var HELM_REPO_V1BETA2_GVK = resid.NewGvk("source.toolkit.fluxcd.io", "v1beta2", "HelmRepository")
+var OCI_REPO_V1BETA2_GVK = resid.NewGvk("source.toolkit.fluxcd.io", "v1beta2", "OCIRepository")
+var OCI_REPO_V1_GVK = resid.NewGvk("source.toolkit.fluxcd.io", "v1", "OCIRepository")
+var HELM_CHART_V1BETA2_GVK = resid.NewGvk("source.toolkit.fluxcd.io", "v1beta2", "HelmChart")
+var HELM_CHART_V1_GVK = resid.NewGvk("source.toolkit.fluxcd.io", "v1", "HelmChart")
 var SECRET_GVK = resid.NewGvk("", "v1", "Secret")
 var CONFIGMAP_GVK = resid.NewGvk("", "v1", "ConfigMap")
 
 type HelmRepo struct {
 	render.Render
-	runner       *Runner
-	scheme       *runtime.Scheme
-	releases     []v2.HelmRelease
-	repositories []source.HelmRepository
-	logger       logr.Logger
+	runner        *Runner
+	sources       *sources.Resolver
+	scheme        *runtime.Scheme
+	releases      []v2.HelmRelease
+	chartRefs     map[types.NamespacedName]ChartReference
+	repositories  []source.HelmRepository
+	ociRepos      []source.OCIRepository
+	helmCharts    []source.HelmChart
+	certSecrets   map[types.NamespacedName]string
+	credentials   *credentials.Credentials
+	capabilities  *capabilities.Capabilities
+	lenientValues bool
+	resolutions   []Resolution
+	partial       bool
+	lockReadOnly  bool
+	failures      []render.Failure
+	logger        logr.Logger
 }
 
-func ParseHelmRepo(r *render.Render, runner *Runner, log logr.Logger) (*HelmRepo, error) {
+func ParseHelmRepo(r *render.Render, runner *Runner, resolver *sources.Resolver, log logr.Logger) (*HelmRepo, error) {
 	sch := runtime.NewScheme()
 	_ = scheme.AddToScheme(sch)
 
@@ -54,18 +74,31 @@ func ParseHelmRepo(r *render.Render, runner *Runner, log logr.Logger) (*HelmRepo
 	repo.scheme = sch
 	repo.logger = log
 	repo.runner = runner
+	repo.sources = resolver
+	repo.chartRefs = map[types.NamespacedName]ChartReference{}
+	repo.certSecrets = map[types.NamespacedName]string{}
 
 	for _, res := range r.Resources() {
 		log.Info("found manifest", "group", res.GetGvk().Group, "kind", res.GetGvk().Kind, "version", res.GetGvk().Version)
-		switch res.GetGvk() {
-		case HELM_RELEASE_GVK:
+		gvk := res.GetGvk()
+		switch {
+		case gvk.Group == HELM_RELEASE_GVK.Group && gvk.Kind == HELM_RELEASE_GVK.Kind && isHelmReleaseVersion(gvk.Version):
 			var release v2.HelmRelease
-			if err := repo.convertTyped(res, &release); err != nil {
+			if err := repo.convertTyped(asHelmReleaseV2beta1(res), &release); err != nil {
 				return nil, fmt.Errorf("error converting resource: %w", err)
 			}
-			log.Info("found helm release", "name", release.Name, "namespace", release.Namespace)
+			log.Info("found helm release", "name", release.Name, "namespace", release.Namespace, "version", gvk.Version)
 			repo.releases = append(repo.releases, release)
-		case HELM_REPO_V1BETA1_GVK, HELM_REPO_V1BETA2_GVK:
+			ref, err := chartReference(res)
+			if err != nil {
+				return nil, fmt.Errorf("error reading chartRef of %s/%s: %w", release.Namespace, release.Name, err)
+			}
+			if ref != nil {
+				repo.chartRefs[types.NamespacedName{Namespace: release.Namespace, Name: release.Name}] = *ref
+			}
+		case gvk.Group == HELM_RELEASE_GVK.Group:
+			log.Error(nil, "unsupported helm-controller API version, object is not rendered", "kind", gvk.Kind, "version", gvk.Version, "name", res.GetName(), "namespace", res.GetNamespace())
+		case gvk == HELM_REPO_V1BETA1_GVK, gvk == HELM_REPO_V1BETA2_GVK:
 			var hrepo source.HelmRepository
 			res = res.DeepCopy()
 			res.SetApiVersion(HELM_REPO_V1BETA2_GVK.ApiVersion())
@@ -74,40 +107,167 @@ func ParseHelmRepo(r *render.Render, runner *Runner, log logr.Logger) (*HelmRepo
 			}
 			log.Info("found helm repository", "name", hrepo.Name, "namespace", hrepo.Namespace)
 			repo.repositories = append(repo.repositories, hrepo)
+			name, err := certSecretRef(res)
+			if err != nil {
+				return nil, fmt.Errorf("error reading certSecretRef of %s/%s: %w", hrepo.Namespace, hrepo.Name, err)
+			}
+			if name != "" {
+				repo.certSecrets[types.NamespacedName{Namespace: hrepo.Namespace, Name: hrepo.Name}] = name
+			}
+		case gvk == OCI_REPO_V1BETA2_GVK, gvk == OCI_REPO_V1_GVK:
+			var ociRepo source.OCIRepository
+			res = res.DeepCopy()
+			res.SetApiVersion(OCI_REPO_V1BETA2_GVK.ApiVersion())
+			if err := repo.convertTyped(res, &ociRepo); err != nil {
+				return nil, fmt.Errorf("error converting resource: %w", err)
+			}
+			log.Info("found oci repository", "name", ociRepo.Name, "namespace", ociRepo.Namespace)
+			repo.ociRepos = append(repo.ociRepos, ociRepo)
+		case gvk == HELM_CHART_V1BETA2_GVK, gvk == HELM_CHART_V1_GVK:
+			var helmChart source.HelmChart
+			res = res.DeepCopy()
+			res.SetApiVersion(HELM_CHART_V1BETA2_GVK.ApiVersion())
+			if err := repo.convertTyped(res, &helmChart); err != nil {
+				return nil, fmt.Errorf("error converting resource: %w", err)
+			}
+			log.Info("found helm chart", "name", helmChart.Name, "namespace", helmChart.Namespace)
+			repo.helmCharts = append(repo.helmCharts, helmChart)
 		}
 	}
 
 	return &repo, nil
 }
 
-func (r *HelmRepo) RenderAllCharts() (resmap.ResMap, error) {
-	tasks := make([]RenderTask, len(r.releases))
-	for i, h := range r.releases {
-		values, err := r.composeValues(h)
-		if err != nil {
-			return nil, fmt.Errorf("error composing values: %w", err)
+// SetCapabilities sets the cluster capabilities charts are rendered with, Helm defaults are used if c is nil
+func (r *HelmRepo) SetCapabilities(c *capabilities.Capabilities) {
+	r.capabilities = c
+}
+
+// SetLenientValues ignores missing valuesFrom references even if they are not optional
+func (r *HelmRepo) SetLenientValues(lenient bool) {
+	r.lenientValues = lenient
+}
+
+// SetCredentials sets local credentials of chart repositories, which take precedence over the
+// secretRef and certSecretRef of HelmRepositories
+func (r *HelmRepo) SetCredentials(c *credentials.Credentials) {
+	r.credentials = c
+}
+
+// SetPartial continues rendering when the chart of a HelmRelease fails to render, and records
+// the failure instead
+func (r *HelmRepo) SetPartial(partial bool) {
+	r.partial = partial
+}
+
+// SetLockReadOnly renders with the chart versions pinned by the lock of the runner, but does not
+// record resolved versions in it, e.g. for the base side of a diff
+func (r *HelmRepo) SetLockReadOnly(readOnly bool) {
+	r.lockReadOnly = readOnly
+}
+
+// Failures returns the HelmReleases which failed to render in the last partial RenderAllCharts
+func (r *HelmRepo) Failures() []render.Failure {
+	return r.failures
+}
+
+// Releases returns all parsed HelmReleases, converted to v2beta1
+func (r *HelmRepo) Releases() []v2.HelmRelease {
+	return r.releases
+}
+
+// RenderAllCharts renders the charts of all HelmReleases, until ctx is done. When rendering
+// partially, failing HelmReleases are skipped and returned by Failures.
+func (r *HelmRepo) RenderAllCharts(ctx context.Context) (resmap.ResMap, error) {
+	r.failures = nil
+	var tasks []RenderTask
+	var releases []v2.HelmRelease
+	for _, h := range r.releases {
+		t, err := r.renderTask(h)
+		if err != nil && r.partial {
+			r.fail(h, err)
+			continue
 		}
-		url, err := r.findHelmChartUrl(&h)
 		if err != nil {
 			return nil, err
 		}
-
-		tasks[i] = RenderTask{
-			values: values,
-			chart:  h.Spec.Chart.Spec.Chart,
-			version: h.Spec.Chart.Spec.Version,
-			repo: repo.Entry{
-				URL:  url,
-				Name: fmt.Sprintf("%s-%s", h.GetNamespace(), h.GetName()),
-			},
-			releaseName:     h.GetReleaseName(),
-			skipCRDs:        h.Spec.GetInstall().SkipCRDs,
-			replace:         h.Spec.GetInstall().Replace,
-			disableHooks:    h.Spec.GetInstall().DisableHooks,
-			createNamespace: h.Spec.GetInstall().CreateNamespace,
+		tasks = append(tasks, t)
+		releases = append(releases, h)
+	}
+	rm, err := r.runner.renderCharts(ctx, tasks, r.partial)
+	if err != nil {
+		return nil, err
+	}
+	r.resolutions = nil
+	for i, t := range tasks {
+		if t.err != nil {
+			r.fail(releases[i], t.err)
+		} else if t.resolution != nil {
+			r.resolutions = append(r.resolutions, *t.resolution)
 		}
 	}
-	return r.runner.RenderCharts(context.Background(), tasks)
+	return rm, nil
+}
+
+func (r *HelmRepo) fail(h v2.HelmRelease, err error) {
+	r.logger.Error(err, "skipping HelmRelease", "name", h.Name, "namespace", h.Namespace)
+	r.failures = append(r.failures, render.Failure{
+		Kind:      v2.HelmReleaseKind,
+		Namespace: h.Namespace,
+		Name:      h.Name,
+		Labels:    originLabels(h.Name, h.Namespace),
+		Err:       err,
+	})
+}
+
+// renderTask prepares rendering the chart of h
+func (r *HelmRepo) renderTask(h v2.HelmRelease) (RenderTask, error) {
+	values, err := r.composeValues(h)
+	if err != nil {
+		return RenderTask{}, fmt.Errorf("error composing values: %w", err)
+	}
+	postRenderer, err := postRenderers(h)
+	if err != nil {
+		return RenderTask{}, err
+	}
+	postRendererKey, err := postRenderersKey(h)
+	if err != nil {
+		return RenderTask{}, err
+	}
+	crds, err := installCRDsPolicy(h)
+	if err != nil {
+		return RenderTask{}, fmt.Errorf("HelmRelease %s/%s: %w", h.Namespace, h.Name, err)
+	}
+
+	t := RenderTask{
+		values: values,
+		repo: repo.Entry{
+			Name: fmt.Sprintf("%s-%s", h.GetNamespace(), h.GetName()),
+		},
+		releaseName:      h.GetReleaseName(),
+		namespace:        h.GetReleaseNamespace(),
+		storageNamespace: h.GetStorageNamespace(),
+		skipCRDs:         crds == v2.Skip,
+		includeCRDs:      crds != v2.Skip,
+		replace:          h.Spec.GetInstall().Replace,
+		disableHooks:     h.Spec.GetInstall().DisableHooks,
+		createNamespace:  h.Spec.GetInstall().CreateNamespace,
+		postRenderer:     postRenderer,
+		postRendererKey:  postRendererKey,
+		capabilities:     r.capabilities,
+		release:          fmt.Sprintf("%s/%s", h.GetNamespace(), h.GetName()),
+		lockReadOnly:     r.lockReadOnly,
+	}
+	if err := r.setChart(&h, &t); err != nil {
+		return RenderTask{}, err
+	}
+	return t, nil
+}
+
+// Resolutions returns the chart versions the HelmReleases were rendered with by RenderAllCharts,
+// except for charts from sources or pinned by digest
+func (r *HelmRepo) Resolutions() []Resolution {
+	return r.resolutions
 }
 
 func (r *HelmRepo) composeValues(hr v2.HelmRelease) (chartutil.Values, error) {
@@ -126,14 +286,19 @@ func (r *HelmRepo) composeValues(hr v2.HelmRelease) (chartutil.Values, error) {
 				return nil, fmt.Errorf("error loading configmap %s: %w", namespacedName, err)
 			}
 			if !found {
-				logger.Info("configmap not found, ignoring values", "configmap", namespacedName)
+				if err := r.missingValues(logger, v, fmt.Sprintf("%s '%s' not found", v.Kind, namespacedName)); err != nil {
+					return nil, err
+				}
 				continue
 			}
-			if data, ok := cm.Data[v.GetValuesKey()]; !ok {
-				return nil, fmt.Errorf("missing key '%s' in %s '%s'", v.Kind, v.GetValuesKey(), namespacedName)
-			} else {
-				valuesData = []byte(data)
+			data, ok := cm.Data[v.GetValuesKey()]
+			if !ok {
+				if err := r.missingValues(logger, v, fmt.Sprintf("missing key '%s' in %s '%s'", v.GetValuesKey(), v.Kind, namespacedName)); err != nil {
+					return nil, err
+				}
+				continue
 			}
+			valuesData = []byte(data)
 		case "Secret":
 			var secret corev1.Secret
 			found, err := r.findResource(SECRET_GVK, namespacedName, &secret)
@@ -141,14 +306,19 @@ func (r *HelmRepo) composeValues(hr v2.HelmRelease) (chartutil.Values, error) {
 				return nil, fmt.Errorf("error loading secret %s: %w", namespacedName, err)
 			}
 			if !found {
-				logger.Info("secret not found, ignoring values", "secret", namespacedName)
+				if err := r.missingValues(logger, v, fmt.Sprintf("%s '%s' not found", v.Kind, namespacedName)); err != nil {
+					return nil, err
+				}
 				continue
 			}
-			if data, ok := secret.Data[v.GetValuesKey()]; !ok {
-				return nil, fmt.Errorf("missing key '%s' in %s '%s'", v.Kind, v.GetValuesKey(), namespacedName)
-			} else {
-				valuesData = []byte(data)
+			data, ok := secret.Data[v.GetValuesKey()]
+			if !ok {
+				if err := r.missingValues(logger, v, fmt.Sprintf("missing key '%s' in %s '%s'", v.GetValuesKey(), v.Kind, namespacedName)); err != nil {
+					return nil, err
+				}
+				continue
 			}
+			valuesData = data
 		default:
 			return nil, fmt.Errorf("unsupported ValuesReference kind '%s'", v.Kind)
 		}
@@ -180,28 +350,52 @@ func (r *HelmRepo) composeValues(hr v2.HelmRelease) (chartutil.Values, error) {
 	return transform.MergeMaps(result, hr.GetValues()), nil
 }
 
-func (r *HelmRepo) findHelmChartUrl(source *v2.HelmRelease) (string, error) {
-	namespace := source.Spec.Chart.Spec.SourceRef.Namespace
+// setChartSource sets the chart repository URL and its credentials for charts from a HelmRepository,
+// or the local location of the source for charts from GitRepository and Bucket sources
+func (r *HelmRepo) setChartSource(owner types.NamespacedName, ref v2.CrossNamespaceObjectReference, t *RenderTask) error {
+	namespace := ref.Namespace
 	if namespace == "" {
-		namespace = source.GetNamespace()
+		namespace = owner.Namespace
 	}
-	switch source.Spec.Chart.Spec.SourceRef.Kind {
+	switch ref.Kind {
 	case "HelmRepository":
 		for _, hr := range r.repositories {
-			if hr.GetNamespace() == namespace && hr.GetName() == source.Spec.Chart.Spec.SourceRef.Name {
-				return hr.Spec.URL, nil
+			if hr.GetNamespace() != namespace || hr.GetName() != ref.Name {
+				continue
+			}
+			if hr.Spec.Type == source.HelmRepositoryTypeOCI && !registry.IsOCI(hr.Spec.URL) {
+				return fmt.Errorf("HelmRepository %s/%s is of type oci but its URL '%s' is not", namespace, ref.Name, hr.Spec.URL)
 			}
+			t.repo.URL = hr.Spec.URL
+			return r.setCredentials(hr, t)
 		}
+	case "GitRepository", "Bucket":
+		loc, err := r.sources.Resolve(sources.Ref{Kind: ref.Kind, Namespace: namespace, Name: ref.Name})
+		if err != nil {
+			return fmt.Errorf("error resolving chart source of %s/%s: %w", owner.Namespace, owner.Name, err)
+		}
+		t.source = &loc
+		return nil
 	default:
-		return "", fmt.Errorf("unsupported source kind '%s'", source.Spec.Chart.Spec.SourceRef.Kind)
+		return fmt.Errorf("unsupported source kind '%s'", ref.Kind)
 	}
-	return "", fmt.Errorf("unable to find source '%s'", source.Spec.Chart.Spec.SourceRef.Name)
+	return fmt.Errorf("unable to find source '%s'", ref.Name)
+}
+
+// missingValues fails for missing values references unless they are optional, like helm-controller.
+// In lenient mode, missing references are only logged.
+func (r *HelmRepo) missingValues(logger logr.Logger, v v2.ValuesReference, msg string) error {
+	if !v.Optional && !r.lenientValues {
+		return fmt.Errorf("%s, mark the reference optional or use lenient values", msg)
+	}
+	logger.Info("ignoring values: "+msg, "optional", v.Optional)
+	return nil
 }
 
 func (r *HelmRepo) findResource(gvk resid.Gvk, namespacedName types.NamespacedName, to interface{}) (bool, error) {
-	res, err := r.GetById(resid.NewResIdWithNamespace(gvk, namespacedName.Name, namespacedName.Namespace))
-	if err != nil {
-		return false, nil
+	res, err := r.Lookup(resid.NewResIdWithNamespace(gvk, namespacedName.Name, namespacedName.Namespace))
+	if err != nil || res == nil {
+		return false, err
 	}
 	if err := r.convertTyped(res, to); err != nil {
 		return false, err
@@ -0,0 +1,193 @@
+package helmrender
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Limits bounds the load rendering puts on the machine and on chart repositories. Zero values
+// use the defaults.
+type Limits struct {
+	// Concurrency is the number of charts rendered at the same time
+	Concurrency int
+	// HostConcurrency is the number of concurrent requests per chart repository or registry host
+	HostConcurrency int
+	// Retries is how often requests failing with transient errors are retried
+	Retries int
+}
+
+const (
+	defaultConcurrency     = 8
+	defaultHostConcurrency = 4
+	defaultRetries         = 3
+	retryWaitMin           = 500 * time.Millisecond
+	retryWaitMax           = 10 * time.Second
+)
+
+// transientStatus matches the HTTP status of throttled and temporarily failing requests in errors
+// of Helm and the registry client, which do not expose the response. Codes are only matched after
+// "status code", so that chart versions like 1.500.0 do not match.
+var transientStatus = regexp.MustCompile(`status code:? (429|50[0234])\b|Too Many Requests|Internal Server Error|Bad Gateway|Service Unavailable|Gateway Timeout`)
+
+// limiter implements Limits
+type limiter struct {
+	lock            sync.Mutex
+	workers         chan struct{}
+	hostConcurrency int
+	retries         int
+	hosts           map[string]chan struct{}
+}
+
+func newLimiter() *limiter {
+	l := &limiter{}
+	l.set(Limits{})
+	return l
+}
+
+func (l *limiter) set(limits Limits) {
+	if limits.Concurrency <= 0 {
+		limits.Concurrency = defaultConcurrency
+	}
+	if limits.HostConcurrency <= 0 {
+		limits.HostConcurrency = defaultHostConcurrency
+	}
+	if limits.Retries < 0 {
+		limits.Retries = 0
+	} else if limits.Retries == 0 {
+		limits.Retries = defaultRetries
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.workers = make(chan struct{}, limits.Concurrency)
+	l.hostConcurrency = limits.HostConcurrency
+	l.retries = limits.Retries
+	l.hosts = map[string]chan struct{}{}
+}
+
+// worker blocks until a chart may be rendered and returns a function to release the slot
+func (l *limiter) worker(ctx context.Context) (func(), error) {
+	return acquire(ctx, l.workers)
+}
+
+// host blocks until a request to host may be sent and returns a function to release the slot
+func (l *limiter) host(ctx context.Context, host string) (func(), error) {
+	l.lock.Lock()
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, l.hostConcurrency)
+		l.hosts[host] = sem
+	}
+	l.lock.Unlock()
+	return acquire(ctx, sem)
+}
+
+func acquire(ctx context.Context, sem chan struct{}) (func(), error) {
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetch runs fn, which requests rawURL, within the limit of its host. Transient failures are
+// retried with exponential backoff.
+func (l *limiter) fetch(ctx context.Context, rawURL string, fn func() error) error {
+	host := hostOf(rawURL)
+	for attempt := 0; ; attempt++ {
+		release, err := l.host(ctx, host)
+		if err != nil {
+			return err
+		}
+		err = fn()
+		release()
+		if err == nil || attempt >= l.retries || !isTransient(err) {
+			return err
+		}
+		select {
+		case <-time.After(retryablehttp.DefaultBackoff(retryWaitMin, retryWaitMax, attempt, nil)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// client returns a client based on c which respects the host limits and retries transient failures
+func (l *limiter) client(c *http.Client) *retryablehttp.Client {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c.Transport = &hostTransport{limiter: l, next: next}
+	rc := retryablehttp.NewClient()
+	rc.HTTPClient = c
+	rc.RetryMax = l.retries
+	rc.RetryWaitMin = retryWaitMin
+	rc.RetryWaitMax = retryWaitMax
+	rc.Logger = nil
+	return rc
+}
+
+type hostTransport struct {
+	limiter *limiter
+	next    http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.limiter.host(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody holds the host slot of a request until its response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func isTransient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return transientStatus.MatchString(err.Error())
+}
+
+// hostOf returns the host of a URL or of an OCI reference without scheme
+func hostOf(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	if u, err := url.Parse("oci://" + rawURL); err == nil {
+		return u.Host
+	}
+	return rawURL
+}
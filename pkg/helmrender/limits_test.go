@@ -0,0 +1,230 @@
+package helmrender_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// flakyChartRepository serves charts, failing the first request of every path with 503 and
+// recording the maximum number of concurrent requests
+func flakyChartRepository(t *testing.T) (*httptest.Server, func() int) {
+	charts := t.TempDir()
+	if _, err := chartutil.Save(testChart("1.0.0"), charts); err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	failed := map[string]bool{}
+	var inFlight, maxInFlight int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		fail := !failed[req.URL.Path]
+		failed[req.URL.Path] = true
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.URL.Path != "/index.yaml" {
+			http.ServeFile(w, req, filepath.Join(charts, filepath.Base(req.URL.Path)))
+			return
+		}
+		index, err := repo.IndexDirectory(charts, srv.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		path := filepath.Join(t.TempDir(), "index.yaml")
+		_ = index.WriteFile(path, 0o644)
+		data, _ := os.ReadFile(path)
+		_, _ = w.Write(data)
+	}))
+	return srv, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return maxInFlight
+	}
+}
+
+func limitsRepo(t *testing.T, url, version string) filesys.FileSystem {
+	manifests := []string{fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: charts
+  namespace: default
+spec:
+  url: %s
+`, url)}
+	for i := 0; i < 4; i++ {
+		manifests = append(manifests, fmt.Sprintf(`apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: demo-%d
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      version: "%s"
+      sourceRef:
+        kind: HelmRepository
+        name: charts
+`, i, version))
+	}
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(strings.Join(manifests, "---\n"))); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestLimits(t *testing.T) {
+	t.Run("retries transient failures", func(t *testing.T) {
+		srv, maxInFlight := flakyChartRepository(t)
+		defer srv.Close()
+		for _, cache := range []bool{false, true} {
+			runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+			runner.SetLimits(helmrender.Limits{HostConcurrency: 1})
+			if cache {
+				runner.SetCache(t.TempDir(), time.Hour)
+			}
+			out, err := renderRepoWith(t, limitsRepo(t, srv.URL, "1.x"), "/repo", runner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(out, "version: 1.0.0"); n != 4 {
+				t.Errorf("expected 4 rendered releases, got %d:\n%s", n, out)
+			}
+		}
+		if n := maxInFlight(); n != 1 {
+			t.Errorf("expected at most one concurrent request, got %d", n)
+		}
+	})
+
+	t.Run("no retries", func(t *testing.T) {
+		srv, _ := flakyChartRepository(t)
+		defer srv.Close()
+		runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+		runner.SetLimits(helmrender.Limits{Retries: -1})
+		_, err := renderRepoWith(t, limitsRepo(t, srv.URL, "1.x"), "/repo", runner)
+		if err == nil || !strings.Contains(err.Error(), "503") {
+			t.Errorf("expected 503 error, got %v", err)
+		}
+	})
+
+	t.Run("versions are not statuses", func(t *testing.T) {
+		srv, _ := flakyChartRepository(t)
+		defer srv.Close()
+		runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+		start := time.Now()
+		_, err := renderRepoWith(t, limitsRepo(t, srv.URL, "1.500.0"), "/repo", runner)
+		if err == nil || !strings.Contains(err.Error(), "1.500.0") {
+			t.Fatalf("expected the missing version to fail, got %v", err)
+		}
+		// only the failed index download is retried, retrying the lookup backs off for seconds
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("expected the missing version not to be retried, took %s", d)
+		}
+	})
+}
+
+func TestHostSlotHeldUntilBodyClosed(t *testing.T) {
+	charts := t.TempDir()
+	if _, err := chartutil.Save(testChart("1.0.0"), charts); err != nil {
+		t.Fatal(err)
+	}
+	// index bodies are sent some time after the headers
+	var lock sync.Mutex
+	var inFlight, maxInFlight int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		defer func() {
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+		}()
+		if filepath.Base(req.URL.Path) != "index.yaml" {
+			http.ServeFile(w, req, filepath.Join(charts, filepath.Base(req.URL.Path)))
+			return
+		}
+		index, err := repo.IndexDirectory(charts, srv.URL+filepath.Dir(req.URL.Path))
+		if err != nil {
+			t.Error(err)
+		}
+		path := filepath.Join(t.TempDir(), "index.yaml")
+		_ = index.WriteFile(path, 0o644)
+		data, _ := os.ReadFile(path)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	var manifests []string
+	for _, name := range []string{"a", "b"} {
+		manifests = append(manifests, fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: %[1]s
+  namespace: default
+spec:
+  url: %[2]s/%[1]s
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: %[1]s
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      sourceRef:
+        kind: HelmRepository
+        name: %[1]s
+`, name, srv.URL))
+	}
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(strings.Join(manifests, "---\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+	runner.SetLimits(helmrender.Limits{HostConcurrency: 1})
+	runner.SetCache(t.TempDir(), time.Hour)
+	if _, err := renderRepoWith(t, fs, "/repo", runner); err != nil {
+		t.Fatal(err)
+	}
+	if maxInFlight != 1 {
+		t.Errorf("expected at most one concurrent request, got %d", maxInFlight)
+	}
+}
@@ -0,0 +1,142 @@
+package helmrender
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// loadLocalChart loads a chart directory or archive from fs. Directories are copied to disk
+// and loaded by helm, which applies .helmignore.
+func loadLocalChart(fs filesys.FileSystem, path string) (*chart.Chart, error) {
+	if !fs.Exists(path) {
+		return nil, fmt.Errorf("chart path '%s' not found", path)
+	}
+	if !fs.IsDir(path) {
+		content, err := fs.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return loader.LoadArchive(bytes.NewReader(content))
+	}
+
+	dir, err := os.MkdirTemp("", "flux-helm-preview-chart-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	err = fs.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0o700)
+		}
+		data, err := fs.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, rel), data, 0o600)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading chart '%s': %w", path, err)
+	}
+	return loader.LoadDir(dir)
+}
+
+// buildDependencies adds the dependencies declared in Chart.yaml which are not vendored in
+// charts/. Like `helm dependency build`, versions are pinned by Chart.lock if present.
+func (r *Runner) buildDependencies(ctx context.Context, install *action.Install, client *registry.Client, fs filesys.FileSystem, path string, ch *chart.Chart) error {
+	present := map[string]bool{}
+	for _, d := range ch.Dependencies() {
+		present[d.Name()] = true
+	}
+	var locked map[string]string
+	if ch.Lock != nil {
+		locked = map[string]string{}
+		for _, d := range ch.Lock.Dependencies {
+			locked[d.Name] = d.Version
+		}
+	}
+	for _, dep := range ch.Metadata.Dependencies {
+		if present[dep.Name] {
+			continue
+		}
+		var sub *chart.Chart
+		var err error
+		opts := install.ChartPathOptions
+		opts.Version = dep.Version
+		if locked != nil {
+			v, ok := locked[dep.Name]
+			if !ok {
+				return fmt.Errorf("dependency '%s' is missing from Chart.lock, run helm dependency update", dep.Name)
+			}
+			opts.Version = v
+		}
+		switch {
+		case strings.HasPrefix(dep.Repository, "file://"):
+			p := strings.TrimPrefix(dep.Repository, "file://")
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(path, p)
+			}
+			if sub, err = loadLocalChart(fs, p); err == nil {
+				err = r.buildDependencies(ctx, install, client, fs, p, sub)
+			}
+		case registry.IsOCI(dep.Repository):
+			sub, err = r.locateDependency(ctx, opts, client, strings.TrimSuffix(dep.Repository, "/")+"/"+dep.Name)
+		case strings.HasPrefix(dep.Repository, "https://"), strings.HasPrefix(dep.Repository, "http://"):
+			opts.RepoURL = dep.Repository
+			sub, err = r.locateDependency(ctx, opts, client, dep.Name)
+		case dep.Repository == "":
+			err = fmt.Errorf("not found in charts/")
+		case strings.HasPrefix(dep.Repository, "@"), strings.HasPrefix(dep.Repository, "alias:"):
+			err = fmt.Errorf("repository '%s' refers to a repository name, which is not supported, use the repository URL", dep.Repository)
+		default:
+			err = fmt.Errorf("unsupported repository '%s'", dep.Repository)
+		}
+		if err != nil {
+			return fmt.Errorf("dependency '%s': %w", dep.Name, err)
+		}
+		ch.AddDependency(sub)
+	}
+	return nil
+}
+
+// locateDependency loads the dependency name from the chart repository opts.RepoURL, or from the
+// OCI reference name if opts.RepoURL is empty
+func (r *Runner) locateDependency(ctx context.Context, opts action.ChartPathOptions, client *registry.Client, name string) (*chart.Chart, error) {
+	switch {
+	case r.offline && opts.RepoURL == "":
+		return r.mirror.ociChart(name, opts.Version, "", "")
+	case r.offline:
+		return r.mirror.repoChart(opts.RepoURL, name, opts.Version)
+	case opts.RepoURL == "":
+		return r.locateOCIChart(ctx, opts, client, name)
+	}
+	return r.locateRepoChart(ctx, opts, &repo.Entry{
+		Name:                  fmt.Sprintf("dependency-%x", sha256.Sum256([]byte(opts.RepoURL))),
+		URL:                   opts.RepoURL,
+		Username:              opts.Username,
+		Password:              opts.Password,
+		CertFile:              opts.CertFile,
+		KeyFile:               opts.KeyFile,
+		CAFile:                opts.CaFile,
+		InsecureSkipTLSverify: opts.InsecureSkipTLSverify,
+		PassCredentialsAll:    opts.PassCredentialsAll,
+	}, name)
+}
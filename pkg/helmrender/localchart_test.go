@@ -0,0 +1,117 @@
+package helmrender_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func TestRenderGitRepositoryChart(t *testing.T) {
+	srv, _ := testRegistry(t, "charts/demo", testChart("1.0.0"), testChart("1.2.0"))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	fs := filesys.MakeFsInMemory()
+	files := map[string]string{
+		"/clusters/prod/release.yaml": `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: app
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: ./charts/app
+      sourceRef:
+        kind: GitRepository
+        name: flux-system
+        namespace: flux-system
+`,
+		"/charts/app/Chart.yaml": fmt.Sprintf(`apiVersion: v2
+name: app
+version: 0.1.0
+dependencies:
+- name: common
+  version: 0.1.0
+  repository: file://../common
+- name: demo
+  version: 1.x
+  repository: oci://%s/charts
+`, host),
+		"/charts/app/Chart.lock": fmt.Sprintf(`dependencies:
+- name: common
+  repository: file://../common
+  version: 0.1.0
+- name: demo
+  repository: oci://%s/charts
+  version: 1.0.0
+digest: sha256:0000000000000000000000000000000000000000000000000000000000000000
+generated: "2024-01-01T00:00:00Z"
+`, host),
+		"/charts/app/.helmignore":            "templates/ignored.yaml\n",
+		"/charts/app/templates/ignored.yaml": "{{ fail \"ignored\" }}\n",
+		"/charts/app/values.yaml":            "demo:\n  message: from-parent\n",
+		"/charts/app/templates/cm.yaml":      "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app-config\n",
+		"/charts/common/Chart.yaml":          "apiVersion: v2\nname: common\nversion: 0.1.0\n",
+		"/charts/common/templates/s.yaml":    "apiVersion: v1\nkind: Secret\nmetadata:\n  name: common\n",
+	}
+	for p, c := range files {
+		if err := fs.WriteFile(p, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := renderRepo(t, fs, "/clusters/prod", testSettings(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"name: app-config", "name: common", "message: from-parent", "version: 1.0.0"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in rendered chart:\n%s", s, out)
+		}
+	}
+}
+
+func TestReleaseNamespace(t *testing.T) {
+	fs := filesys.MakeFsInMemory()
+	files := map[string]string{
+		"/clusters/prod/release.yaml": `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: app
+  namespace: flux-system
+spec:
+  targetNamespace: apps
+  storageNamespace: flux-system
+  chart:
+    spec:
+      chart: ./charts/app
+      sourceRef:
+        kind: GitRepository
+        name: flux-system
+`,
+		"/charts/app/Chart.yaml":        "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"/charts/app/templates/cm.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}\ndata:\n  namespace: {{ .Release.Namespace }}\n",
+		"/charts/app/templates/cr.yaml": "apiVersion: rbac.authorization.k8s.io/v1\nkind: ClusterRole\nmetadata:\n  name: app\n",
+	}
+	for p, c := range files {
+		if err := fs.WriteFile(p, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := renderRepo(t, fs, "/clusters/prod", testSettings(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"name: apps-app\n  namespace: apps\n", "namespace: apps\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in rendered chart:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "name: app\n  namespace:") {
+		t.Errorf("cluster scoped object should have no namespace:\n%s", out)
+	}
+}
@@ -0,0 +1,146 @@
+package helmrender
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+// Resolution is the chart version a HelmRelease was rendered with
+type Resolution struct {
+	// Release is the HelmRelease as namespace/name
+	Release string `yaml:"release"`
+	// Repository is the chart repository URL, empty for charts referenced by OCI URL
+	Repository string `yaml:"repository,omitempty"`
+	Chart      string `yaml:"chart"`
+	// Constraint is the version range, exact version or tag requested by the HelmRelease
+	Constraint string `yaml:"constraint,omitempty"`
+	Version    string `yaml:"version"`
+	// Digest identifies the content of the chart and its dependencies
+	Digest string `yaml:"digest"`
+}
+
+// IsRange reports whether the constraint may resolve to different versions over time
+func (r Resolution) IsRange() bool {
+	_, err := semver.StrictNewVersion(strings.TrimPrefix(strings.TrimPrefix(r.Constraint, "="), "v"))
+	return err != nil
+}
+
+func (r Resolution) key() string {
+	return strings.Join([]string{r.Release, r.Repository, r.Chart, r.Constraint}, "\x00")
+}
+
+// lockFile is the content of a lock file
+type lockFile struct {
+	Charts []Resolution `yaml:"charts"`
+}
+
+// Lock pins the chart versions HelmReleases are rendered with, so previews of the same manifests
+// render the same charts. Releases which are not locked yet are resolved and added.
+type Lock struct {
+	lock   sync.Mutex
+	pinned map[string]Resolution
+	used   map[string]Resolution
+}
+
+func NewLock() *Lock {
+	return &Lock{pinned: map[string]Resolution{}, used: map[string]Resolution{}}
+}
+
+// LoadLock reads a lock file written by Write
+func LoadLock(r io.Reader) (*Lock, error) {
+	var f lockFile
+	if err := yaml.NewDecoder(r).Decode(&f); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error parsing lock file: %w", err)
+	}
+	l := NewLock()
+	for _, c := range f.Charts {
+		l.pinned[c.key()] = c
+	}
+	return l, nil
+}
+
+// Write writes the loaded resolutions together with those used since, which take precedence.
+// Pins of releases which were not rendered, e.g. because they failed, are kept.
+func (l *Lock) Write(w io.Writer) error {
+	l.lock.Lock()
+	charts := make(map[string]Resolution, len(l.pinned)+len(l.used))
+	for k, c := range l.pinned {
+		charts[k] = c
+	}
+	for k, c := range l.used {
+		charts[k] = c
+	}
+	l.lock.Unlock()
+	f := lockFile{Charts: make([]Resolution, 0, len(charts))}
+	for _, c := range charts {
+		f.Charts = append(f.Charts, c)
+	}
+	sort.Slice(f.Charts, func(i, j int) bool { return f.Charts[i].key() < f.Charts[j].key() })
+	e := yaml.NewEncoder(w)
+	e.SetIndent(2)
+	if err := e.Encode(&f); err != nil {
+		return err
+	}
+	return e.Close()
+}
+
+// Changed reports whether Write would add or change resolutions of the loaded lock file
+func (l *Lock) Changed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for k, c := range l.used {
+		if l.pinned[k] != c {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Lock) pin(r Resolution) (Resolution, bool) {
+	if l == nil {
+		return Resolution{}, false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	p, ok := l.pinned[r.key()]
+	return p, ok
+}
+
+// record adds r to the lock. A locked digest must match.
+func (l *Lock) record(r Resolution) error {
+	if err := l.verify(r); err != nil || l == nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.used[r.key()] = r
+	return nil
+}
+
+// verify checks that r matches a locked digest without adding it to the lock
+func (l *Lock) verify(r Resolution) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if p, ok := l.pinned[r.key()]; ok && p.Digest != "" && p.Digest != r.Digest {
+		return fmt.Errorf("chart %s %s of HelmRelease %s has digest %s, but %s is locked", r.Chart, r.Version, r.Release, r.Digest, p.Digest)
+	}
+	return nil
+}
+
+// chartDigest returns the digest of the files of ch and its dependencies
+func chartDigest(ch *chart.Chart) string {
+	h := sha256.New()
+	hashChart(h, ch)
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
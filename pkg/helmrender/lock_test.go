@@ -0,0 +1,124 @@
+package helmrender_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func TestLock(t *testing.T) {
+	srv, _ := testRegistry(t, "charts/demo", testChart("1.0.0"), testChart("1.2.0"))
+	defer srv.Close()
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: charts
+  namespace: default
+spec:
+  type: oci
+  url: oci://%s/charts
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: demo
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      version: 1.x
+      sourceRef:
+        kind: HelmRepository
+        name: charts
+`, strings.TrimPrefix(srv.URL, "http://")))); err != nil {
+		t.Fatal(err)
+	}
+
+	render := func(lock *helmrender.Lock, opts ...func(*helmrender.HelmRepo)) (string, []helmrender.Resolution, error) {
+		runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+		runner.SetLock(lock)
+		var repo *helmrender.HelmRepo
+		out, err := renderRepoWith(t, fs, "/repo", runner, append(opts, func(r *helmrender.HelmRepo) { repo = r })...)
+		return out, repo.Resolutions(), err
+	}
+
+	lock := helmrender.NewLock()
+	out, resolutions, err := render(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "version: 1.2.0") || len(resolutions) != 1 {
+		t.Fatalf("expected 1.2.0 to be rendered, got %+v:\n%s", resolutions, out)
+	}
+	if r := resolutions[0]; r.Release != "default/demo" || r.Constraint != "1.x" || r.Version != "1.2.0" || !r.IsRange() || !strings.HasPrefix(r.Digest, "sha256:") {
+		t.Errorf("unexpected resolution %+v", r)
+	}
+	if !lock.Changed() {
+		t.Error("expected the resolution to be added to the lock")
+	}
+	var buf bytes.Buffer
+	if err := lock.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	locked, err := helmrender.LoadLock(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := render(locked); err != nil {
+		t.Fatal(err)
+	}
+	if locked.Changed() {
+		t.Error("expected the lock to be unchanged")
+	}
+
+	digest := resolutions[0].Digest
+	pinned, err := helmrender.LoadLock(strings.NewReader(strings.NewReplacer("1.2.0", "1.0.0", digest, "").Replace(buf.String())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _, err := render(pinned); err != nil || !strings.Contains(out, "version: 1.0.0") {
+		t.Errorf("expected the locked version 1.0.0 to be rendered, got %v:\n%s", err, out)
+	}
+
+	mismatch, err := helmrender.LoadLock(strings.NewReader(strings.Replace(buf.String(), digest, "sha256:0000", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := render(mismatch); err == nil || !strings.Contains(err.Error(), "is locked") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+
+	// pins of releases which are not rendered are kept
+	absent := "  - release: default/absent\n    chart: other\n    constraint: 2.x\n    version: 2.1.0\n    digest: sha256:1111\n"
+	withAbsent, err := helmrender.LoadLock(strings.NewReader(strings.NewReplacer("1.2.0", "1.0.0", digest, "").Replace(buf.String()) + absent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := render(withAbsent); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := withAbsent.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "release: default/absent") || !strings.Contains(buf.String(), "version: 1.0.0") {
+		t.Errorf("expected the pin of the absent release to be kept:\n%s", buf.String())
+	}
+
+	// read only renders use the lock without recording in it
+	readOnly := helmrender.NewLock()
+	if _, _, err := render(readOnly, func(r *helmrender.HelmRepo) { r.SetLockReadOnly(true) }); err != nil {
+		t.Fatal(err)
+	}
+	if readOnly.Changed() {
+		t.Error("expected a read only render not to change the lock")
+	}
+}
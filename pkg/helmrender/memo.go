@@ -0,0 +1,125 @@
+package helmrender
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+
+	v2 "github.com/fluxcd/helm-controller/api/v2beta1"
+	"helm.sh/helm/v3/pkg/chart"
+	"sigs.k8s.io/kustomize/api/resmap"
+)
+
+// memo keeps rendered charts by everything that affects their output, so releases which are
+// identical on both sides of a diff are only rendered once. Failed renders are not kept.
+type memo struct {
+	lock     sync.Mutex
+	results  map[string]*memoEntry
+	rendered int
+	reused   int
+}
+
+type memoEntry struct {
+	done chan struct{}
+	rm   resmap.ResMap
+	err  error
+}
+
+func newMemo() *memo {
+	return &memo{results: map[string]*memoEntry{}}
+}
+
+// do returns a copy of the result stored under key, or stores the result of render. Concurrent
+// calls with the same key wait for the first one.
+func (m *memo) do(key string, render func() (resmap.ResMap, error)) (resmap.ResMap, bool, error) {
+	m.lock.Lock()
+	e, ok := m.results[key]
+	if ok {
+		m.reused++
+		m.lock.Unlock()
+		<-e.done
+		if e.err != nil {
+			return nil, true, e.err
+		}
+		return e.rm.DeepCopy(), true, nil
+	}
+	e = &memoEntry{done: make(chan struct{})}
+	m.results[key] = e
+	m.rendered++
+	m.lock.Unlock()
+
+	e.rm, e.err = render()
+	if e.err != nil {
+		m.lock.Lock()
+		delete(m.results, key)
+		m.lock.Unlock()
+		close(e.done)
+		return nil, false, e.err
+	}
+	rm := e.rm.DeepCopy()
+	close(e.done)
+	return rm, false, nil
+}
+
+func (m *memo) stats() (rendered, reused int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.rendered, m.reused
+}
+
+// renderKey returns the memoization key of rendering ch with the task. The chart is identified by
+// the digest of its files, so it covers the resolved version and values files merged into it.
+func renderKey(ch *chart.Chart, t *RenderTask) (string, error) {
+	h := sha256.New()
+	hashChart(h, ch)
+	values, err := json.Marshal(t.values)
+	if err != nil {
+		return "", err
+	}
+	defaults, err := json.Marshal(ch.Values)
+	if err != nil {
+		return "", err
+	}
+	var kubeVersion string
+	var apiVersions []string
+	if t.capabilities != nil {
+		if t.capabilities.KubeVersion != nil {
+			kubeVersion = t.capabilities.KubeVersion.String()
+		}
+		apiVersions = t.capabilities.APIVersions
+	}
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%t %t %t %t %t\x00%s",
+		values, defaults, t.releaseName, t.namespace, t.storageNamespace, kubeVersion, strings.Join(apiVersions, ","),
+		t.createNamespace, t.skipCRDs, t.includeCRDs, t.replace, t.disableHooks, t.postRendererKey)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashChart writes the metadata and files of ch and its dependencies to h
+func hashChart(h hash.Hash, ch *chart.Chart) {
+	fmt.Fprintf(h, "%s\x00%s\x00", ch.Name(), ch.Metadata.Version)
+	files := append([]*chart.File{}, ch.Raw...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%d\x00", f.Name, len(f.Data))
+		h.Write(f.Data)
+	}
+	deps := append([]*chart.Chart{}, ch.Dependencies()...)
+	sort.Slice(deps, func(i, j int) bool { return deps[i].Name() < deps[j].Name() })
+	for _, d := range deps {
+		hashChart(h, d)
+	}
+}
+
+// postRenderersKey identifies the output of postRenderers(hr)
+func postRenderersKey(hr v2.HelmRelease) (string, error) {
+	key, err := json.Marshal(struct {
+		Name          string
+		Namespace     string
+		PostRenderers []v2.PostRenderer
+	}{hr.Name, hr.Namespace, hr.Spec.PostRenderers})
+	return string(key), err
+}
@@ -0,0 +1,41 @@
+package helmrender_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+)
+
+func TestMemoizeRenders(t *testing.T) {
+	runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+	render := func(extra map[string]string) string {
+		out, err := renderRepoWith(t, valuesFs(t, "  - kind: ConfigMap\n    name: values\n    optional: true\n", extra), "/clusters/prod", runner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	a := render(nil)
+	b := render(nil)
+	if a != b {
+		t.Errorf("reused render differs:\n%s\n---\n%s", a, b)
+	}
+	if rendered, reused := runner.RenderStats(); rendered != 1 || reused != 1 {
+		t.Errorf("expected 1 rendered and 1 reused chart, got %d and %d", rendered, reused)
+	}
+
+	changed := render(map[string]string{"/clusters/prod/values.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: values\n  namespace: default\ndata:\n  values.yaml: 'message: changed'\n"})
+	if !strings.Contains(changed, "message: changed") {
+		t.Errorf("expected changed values to be rendered:\n%s", changed)
+	}
+	changedTemplate := render(map[string]string{"/charts/app/templates/extra.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: extra\n"})
+	if !strings.Contains(changedTemplate, "name: extra") {
+		t.Errorf("expected changed chart to be rendered:\n%s", changedTemplate)
+	}
+	if rendered, reused := runner.RenderStats(); rendered != 3 || reused != 1 {
+		t.Errorf("expected 3 rendered and 1 reused chart, got %d and %d", rendered, reused)
+	}
+}
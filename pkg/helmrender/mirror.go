@@ -0,0 +1,201 @@
+package helmrender
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+)
+
+// mirror is a local directory of chart repository indexes and chart archives. Charts of a chart
+// repository are stored next to its index at <host>/<path>/, charts of OCI registries at
+// oci/<host>/<path>/<chart>/ with one archive per version, tag or digest.
+type mirror struct {
+	dir string
+	// lock guards updates of the mirrored indexes
+	lock sync.Mutex
+}
+
+func (m *mirror) repoDir(repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid repository URL '%s': %w", repoURL, err)
+	}
+	dir := filepath.Join(m.dir, u.Host, filepath.FromSlash(u.Path))
+	if registry.IsOCI(repoURL) {
+		dir = filepath.Join(m.dir, registry.OCIScheme, u.Host, filepath.FromSlash(u.Path))
+	}
+	if !strings.HasPrefix(dir, filepath.Clean(m.dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid repository URL '%s'", repoURL)
+	}
+	return dir, nil
+}
+
+// repoChart loads the chart of a chart repository matching the version constraint
+func (m *mirror) repoChart(repoURL, name, version string) (*chart.Chart, error) {
+	dir, err := m.repoDir(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	index, err := repo.LoadIndexFile(filepath.Join(dir, "index.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("repository '%s' is not mirrored: %w", repoURL, err)
+	}
+	cv, err := index.Get(name, version)
+	if err != nil {
+		return nil, fmt.Errorf("chart '%s' version '%s' not found in mirrored repository '%s': %w", name, version, repoURL, err)
+	}
+	return m.load(filepath.Join(dir, fmt.Sprintf("%s-%s.tgz", cv.Name, cv.Version)), name, cv.Version)
+}
+
+// storeRepoChart stores a chart archive downloaded from a chart repository and adds its entry
+// in the repository index at indexPath to the mirrored index. The mirrored index lists only
+// mirrored archives, so that version constraints resolve to them offline.
+func (m *mirror) storeRepoChart(repoURL, indexPath, chartPath string, ch *chart.Chart) error {
+	dir, err := m.repoDir(repoURL)
+	if err != nil {
+		return err
+	}
+	upstream, err := repo.LoadIndexFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var entry *repo.ChartVersion
+	for _, cv := range upstream.Entries[ch.Name()] {
+		if cv.Version == ch.Metadata.Version {
+			entry = cv
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("chart '%s' version '%s' not found in the index of '%s'", ch.Name(), ch.Metadata.Version, repoURL)
+	}
+	archive := fmt.Sprintf("%s-%s.tgz", ch.Name(), ch.Metadata.Version)
+	if err := copyFile(chartPath, filepath.Join(dir, archive)); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	indexFile := filepath.Join(dir, "index.yaml")
+	index, err := repo.LoadIndexFile(indexFile)
+	if os.IsNotExist(err) {
+		index, err = repo.NewIndexFile(), nil
+	}
+	if err != nil {
+		return err
+	}
+	mirrored := *entry
+	mirrored.URLs = []string{archive}
+	versions := repo.ChartVersions{&mirrored}
+	for _, cv := range index.Entries[ch.Name()] {
+		if cv.Version != mirrored.Version {
+			versions = append(versions, cv)
+		}
+	}
+	index.Entries[ch.Name()] = versions
+	index.SortEntries()
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(indexFile, data)
+}
+
+// ociChart loads the chart at the oci:// reference by digest, tag, or the highest version
+// matching the constraint
+func (m *mirror) ociChart(ref, version, tag, digest string) (*chart.Chart, error) {
+	dir, err := m.repoDir(ref)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case digest != "":
+		return m.load(filepath.Join(dir, ociArchive(digest)), ref, digest)
+	case tag != "":
+		return m.load(filepath.Join(dir, ociArchive(tag)), ref, tag)
+	}
+
+	constraint, err := semver.NewConstraint("*")
+	if version != "" {
+		constraint, err = semver.NewConstraint(version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid version constraint '%s': %w", version, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var latest *semver.Version
+	for _, e := range entries {
+		v, err := semver.NewVersion(strings.TrimSuffix(e.Name(), ".tgz"))
+		if err != nil || !constraint.Check(v) {
+			continue
+		}
+		if latest == nil || v.GreaterThan(latest) {
+			latest = v
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("chart '%s' version '%s' is not mirrored", ref, version)
+	}
+	return m.load(filepath.Join(dir, ociArchive(latest.Original())), ref, latest.Original())
+}
+
+// storeOCIChart stores the archive of the chart at the oci:// reference under its version, tag or digest
+func (m *mirror) storeOCIChart(ref, version string, data []byte) error {
+	dir, err := m.repoDir(ref)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, ociArchive(version)), data)
+}
+
+func (m *mirror) load(path, name, version string) (*chart.Chart, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("chart '%s' version '%s' is not mirrored: %w", name, version, err)
+	}
+	return loader.Load(path)
+}
+
+// ociArchive returns the archive name of a version, tag or digest
+func ociArchive(version string) string {
+	return strings.ReplaceAll(version, ":", "-") + ".tgz"
+}
+
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(to, data)
+}
+
+// writeFileAtomic writes data atomically, as concurrent renders may store the same file
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
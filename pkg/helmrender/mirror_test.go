@@ -0,0 +1,168 @@
+package helmrender_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/credentials"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func TestMirror(t *testing.T) {
+	registry, _ := testRegistry(t, "charts/demo", testChart("1.0.0"), testChart("1.2.0"))
+	host := strings.TrimPrefix(registry.URL, "http://")
+	repository := testChartRepository(t, "user", "s3cret", false)
+	creds, err := credentials.Load(strings.NewReader(fmt.Sprintf("repositories:\n- url: %s\n  username: user\n  password: s3cret\n", repository.URL)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := func(name, version, source string) string {
+		return fmt.Sprintf(`---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: %s
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      version: %s
+      sourceRef:
+        kind: HelmRepository
+        name: %s
+`, name, version, source)
+	}
+	manifests := fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: oci
+  namespace: default
+spec:
+  type: oci
+  url: oci://%s/charts
+---
+apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: https
+  namespace: default
+spec:
+  url: %s
+`, host, repository.URL) + release("from-oci", "1.x", "oci") + release("from-https", "", "https")
+
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(manifests)); err != nil {
+		t.Fatal(err)
+	}
+	setCredentials := func(r *helmrender.HelmRepo) { r.SetCredentials(creds) }
+
+	dir := t.TempDir()
+	runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+	runner.SetMirror(dir)
+	online, err := renderRepoWith(t, fs, "/repo", runner, setCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Close()
+	repository.Close()
+
+	runner = helmrender.NewRunner(testSettings(t), logr.Discard())
+	runner.SetOffline(dir)
+	offline, err := renderRepoWith(t, fs, "/repo", runner, setCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offline != online {
+		t.Errorf("offline render differs from online render:\n%s\n---\n%s", offline, online)
+	}
+	if !strings.Contains(offline, "version: 1.2.0") {
+		t.Errorf("expected version 1.2.0 of the OCI chart:\n%s", offline)
+	}
+
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(manifests+release("missing", "2.x", "oci"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderRepoWith(t, fs, "/repo", runner, setCredentials); err == nil || !strings.Contains(err.Error(), "not mirrored") {
+		t.Errorf("expected error for chart missing from the mirror, got %v", err)
+	}
+}
+
+func TestMirrorIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, v := range []string{"1.0.0", "1.2.0"} {
+		if _, err := chartutil.Save(testChart(v), dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/index.yaml" {
+			index, err := repo.IndexDirectory(dir, srv.URL)
+			if err != nil {
+				t.Error(err)
+			}
+			_ = index.WriteFile(filepath.Join(dir, "index.yaml"), 0o644)
+		}
+		http.ServeFile(w, req, filepath.Join(dir, filepath.Base(req.URL.Path)))
+	}))
+	release := func(version string) string {
+		return fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: charts
+  namespace: default
+spec:
+  url: %s
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: demo
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      version: %s
+      sourceRef:
+        kind: HelmRepository
+        name: charts
+`, srv.URL, version)
+	}
+	render := func(runner *helmrender.Runner, version string) (string, error) {
+		fs := filesys.MakeFsInMemory()
+		if err := fs.WriteFile("/repo/releases.yaml", []byte(release(version))); err != nil {
+			t.Fatal(err)
+		}
+		return renderRepoWith(t, fs, "/repo", runner)
+	}
+
+	mirrorDir := t.TempDir()
+	runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+	runner.SetMirror(mirrorDir)
+	if _, err := render(runner, "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	// the range includes 1.2.0, which is listed upstream but not mirrored
+	runner = helmrender.NewRunner(testSettings(t), logr.Discard())
+	runner.SetOffline(mirrorDir)
+	out, err := render(runner, "1.x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "version: 1.0.0") {
+		t.Errorf("expected the mirrored version 1.0.0:\n%s", out)
+	}
+}
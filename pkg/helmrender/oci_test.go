@@ -0,0 +1,282 @@
+package helmrender_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// testRegistry serves charts like an OCI registry with the distribution API. It returns the
+// manifest digests by chart version.
+func testRegistry(t *testing.T, repository string, charts ...*chart.Chart) (*httptest.Server, map[string]string) {
+	blobs := map[string][]byte{}
+	manifests := map[string][]byte{}
+	var tags []string
+	digests := map[string]string{}
+	add := func(content []byte) map[string]interface{} {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+		blobs[digest] = content
+		return map[string]interface{}{"digest": digest, "size": len(content)}
+	}
+	for _, ch := range charts {
+		path, err := chartutil.Save(ch, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _ := json.Marshal(ch.Metadata)
+		configDesc := add(config)
+		configDesc["mediaType"] = registry.ConfigMediaType
+		layerDesc := add(archive)
+		layerDesc["mediaType"] = registry.ChartLayerMediaType
+		manifest, _ := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+			"config":        configDesc,
+			"layers":        []interface{}{layerDesc},
+		})
+		digest := add(manifest)["digest"].(string)
+		manifests[ch.Metadata.Version] = manifest
+		manifests[digest] = manifest
+		digests[ch.Metadata.Version] = digest
+		tags = append(tags, ch.Metadata.Version)
+	}
+
+	prefix := "/v2/" + repository + "/"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case req.URL.Path == prefix+"tags/list":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+		case strings.HasPrefix(req.URL.Path, prefix+"manifests/"):
+			manifest, ok := manifests[strings.TrimPrefix(req.URL.Path, prefix+"manifests/")]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(manifest)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+			if req.Method != http.MethodHead {
+				_, _ = w.Write(manifest)
+			}
+		case strings.HasPrefix(req.URL.Path, prefix+"blobs/"):
+			blob, ok := blobs[strings.TrimPrefix(req.URL.Path, prefix+"blobs/")]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+			if req.Method != http.MethodHead {
+				_, _ = w.Write(blob)
+			}
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	return srv, digests
+}
+
+func testChart(version string) *chart.Chart {
+	return &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "demo", Version: version},
+		Values:   map[string]interface{}{"message": "hello"},
+		Templates: []*chart.File{{
+			Name: "templates/cm.yaml",
+			Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}\ndata:\n  message: {{ .Values.message }}\n  version: {{ .Chart.Version }}\n"),
+		}},
+	}
+}
+
+func testSettings(t *testing.T) *cli.EnvSettings {
+	dir := t.TempDir()
+	settings := cli.New()
+	settings.RepositoryCache = filepath.Join(dir, "cache")
+	settings.RepositoryConfig = filepath.Join(dir, "repositories.yaml")
+	settings.RegistryConfig = filepath.Join(dir, "registry.json")
+	return settings
+}
+
+func renderReleases(t *testing.T, manifests string, settings *cli.EnvSettings) (string, error) {
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(manifests)); err != nil {
+		t.Fatal(err)
+	}
+	return renderRepo(t, fs, "/repo", settings)
+}
+
+// renderRepo renders all HelmReleases at path, with the GitRepository flux-system mapped to fs
+func renderRepo(t *testing.T, fs filesys.FileSystem, path string, settings *cli.EnvSettings, opts ...func(*helmrender.HelmRepo)) (string, error) {
+	return renderRepoWith(t, fs, path, helmrender.NewRunner(settings, logr.Discard()), opts...)
+}
+
+func renderRepoWith(t *testing.T, fs filesys.FileSystem, path string, runner *helmrender.Runner, opts ...func(*helmrender.HelmRepo)) (string, error) {
+	t.Cleanup(func() { _ = runner.Close() })
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	m, err := sources.New(sources.Config{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := m.WithSelf(sources.Location{FS: fs, Path: "/"})
+	repo, err := helmrender.ParseHelmRepo(r, runner, resolver, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range opts {
+		opt(repo)
+	}
+	rm, err := repo.RenderAllCharts(context.Background())
+	if err != nil {
+		return "", err
+	}
+	out, err := rm.AsYaml()
+	return string(out), err
+}
+
+func TestRenderOCIHelmRepository(t *testing.T) {
+	srv, _ := testRegistry(t, "charts/demo", testChart("1.0.0"), testChart("1.2.0"))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	out, err := renderReleases(t, fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: charts
+  namespace: default
+spec:
+  type: oci
+  url: oci://%s/charts
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: demo
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      version: 1.x
+      sourceRef:
+        kind: HelmRepository
+        name: charts
+  values:
+    message: from-oci
+`, host), testSettings(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"message: from-oci", "version: 1.2.0", "helm.toolkit.fluxcd.io/name: demo"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in rendered chart:\n%s", s, out)
+		}
+	}
+}
+
+func TestRenderChartRef(t *testing.T) {
+	srv, digests := testRegistry(t, "charts/demo", testChart("1.0.0"), testChart("1.1.0"), testChart("1.2.0"))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	release := func(kind string) string {
+		return fmt.Sprintf(`---
+apiVersion: helm.toolkit.fluxcd.io/v2
+kind: HelmRelease
+metadata:
+  name: demo
+  namespace: default
+spec:
+  chartRef:
+    kind: %s
+    name: demo
+`, kind)
+	}
+	ociRepo := func(ref string) string {
+		return fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: OCIRepository
+metadata:
+  name: demo
+  namespace: default
+spec:
+  url: oci://%s/charts/demo
+  ref:
+    %s
+`, host, ref)
+	}
+
+	tests := []struct {
+		name      string
+		manifests string
+		want      string
+		err       string
+	}{
+		{"semver", ociRepo("semver: 1.1.x") + release("OCIRepository"), "version: 1.1.0", ""},
+		{"tag", ociRepo("tag: 1.0.0") + release("OCIRepository"), "version: 1.0.0", ""},
+		{"digest", ociRepo("digest: "+digests["1.2.0"]) + release("OCIRepository"), "version: 1.2.0", ""},
+		{"helm chart", fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: charts
+  namespace: default
+spec:
+  type: oci
+  url: oci://%s/charts
+---
+apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmChart
+metadata:
+  name: demo
+  namespace: default
+spec:
+  chart: demo
+  version: 1.0.x
+  sourceRef:
+    kind: HelmRepository
+    name: charts
+`, host) + release("HelmChart"), "version: 1.0.0", ""},
+		{"missing", release("OCIRepository"), "", "OCIRepository default/demo referenced by HelmRelease default/demo not found"},
+		{"unsupported", release("GitRepository"), "", "unsupported chartRef kind 'GitRepository'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := renderReleases(t, tt.manifests, testSettings(t))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("expected %q in rendered chart:\n%s", tt.want, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package helmrender_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func TestPartial(t *testing.T) {
+	srv, _ := testRegistry(t, "charts/demo", testChart("1.0.0"))
+	defer srv.Close()
+	manifests := []string{fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: charts
+  namespace: default
+spec:
+  type: oci
+  url: oci://%s/charts
+`, strings.TrimPrefix(srv.URL, "http://"))}
+	for _, chart := range []string{"demo", "missing"} {
+		manifests = append(manifests, fmt.Sprintf(`apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: %s
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: %s
+      sourceRef:
+        kind: HelmRepository
+        name: charts
+`, chart, chart))
+	}
+	manifests = append(manifests, `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: no-values
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      sourceRef:
+        kind: HelmRepository
+        name: charts
+  valuesFrom:
+    - kind: ConfigMap
+      name: absent
+`)
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/releases.yaml", []byte(strings.Join(manifests, "---\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := renderRepo(t, fs, "/repo", testSettings(t)); err == nil {
+		t.Fatal("expected rendering to fail without partial")
+	}
+
+	var repo *helmrender.HelmRepo
+	out, err := renderRepo(t, fs, "/repo", testSettings(t), func(r *helmrender.HelmRepo) {
+		r.SetPartial(true)
+		repo = r
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "name: demo") || strings.Contains(out, "name: missing") {
+		t.Errorf("expected only demo to be rendered:\n%s", out)
+	}
+	var failed []string
+	for _, f := range repo.Failures() {
+		failed = append(failed, fmt.Sprintf("%s %s/%s", f.Kind, f.Namespace, f.Name))
+		if f.Labels["helm.toolkit.fluxcd.io/name"] != f.Name {
+			t.Errorf("expected origin labels of %s, got %v", f.Name, f.Labels)
+		}
+	}
+	if got := strings.Join(failed, ","); got != "HelmRelease default/no-values,HelmRelease default/missing" {
+		t.Errorf("unexpected failures %s", got)
+	}
+}
@@ -0,0 +1,54 @@
+package helmrender_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPostRenderers(t *testing.T) {
+	srv, _ := testRegistry(t, "charts/demo", testChart("1.0.0"))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	out, err := renderReleases(t, fmt.Sprintf(`apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: charts
+  namespace: default
+spec:
+  type: oci
+  url: oci://%s/charts
+---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: demo
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: demo
+      sourceRef:
+        kind: HelmRepository
+        name: charts
+  postRenderers:
+  - kustomize:
+      patches:
+      - target:
+          kind: ConfigMap
+        patch: |
+          - op: add
+            path: /data/patched
+            value: "yes"
+`, host), testSettings(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"patched: \"yes\"", "helm.toolkit.fluxcd.io/name: demo", "helm.toolkit.fluxcd.io/namespace: default"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in rendered chart:\n%s", s, out)
+		}
+	}
+}
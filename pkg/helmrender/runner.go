@@ -3,18 +3,26 @@ package helmrender
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/capabilities"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
 	"golang.org/x/sync/errgroup"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/postrender"
+	"helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/repo"
 	"sigs.k8s.io/kustomize/api/hasher"
 	"sigs.k8s.io/kustomize/api/resmap"
@@ -27,39 +35,127 @@ type Runner struct {
 	storage  repo.File
 	lock     sync.Mutex
 	repos    sync.Map
+
+	helmConfig HelmConfig
+	homeOnce   sync.Once
+	home       string
+	homeErr    error
+	// homeLock guards renders and closed, which decide when the home can be removed
+	homeLock sync.Mutex
+	renders  int
+	closed   bool
+
+	mirror  *mirror
+	offline bool
+	cache   *cache
+	memo    *memo
+	limiter *limiter
+	locked  *Lock
+	timeout time.Duration
+
+	registryOnce   sync.Once
+	registryClient *registry.Client
+	registryErr    error
 }
 
 type RenderTask struct {
-	values          chartutil.Values
-	chart           string
-	version         string
-	repo            repo.Entry
-	releaseName     string
-	namespace       string
-	createNamespace bool
-	skipCRDs        bool
-	replace         bool
-	disableHooks    bool
-	includeCRDs     bool
+	values           chartutil.Values
+	valuesFiles      []string
+	chart            string
+	version          string
+	tag              string
+	digest           string
+	repo             repo.Entry
+	source           *sources.Location
+	releaseName      string
+	namespace        string
+	storageNamespace string
+	createNamespace  bool
+	skipCRDs         bool
+	replace          bool
+	disableHooks     bool
+	includeCRDs      bool
+	tls              *tlsData
+	postRenderer     postrender.PostRenderer
+	postRendererKey  string
+	capabilities     *capabilities.Capabilities
+	release          string
+	resolution       *Resolution
+	lockReadOnly     bool
+	err              error
 }
 
+// NewRunner creates a Runner based on a copy of settings. Repositories, the repository cache and
+// registry config are kept in a private, temporary Helm home unless set with UseHelmConfig.
 func NewRunner(settings *cli.EnvSettings, log logr.Logger) *Runner {
+	s := *settings
 	return &Runner{
-		settings: settings,
+		settings: &s,
 		logger:   log,
+		memo:     newMemo(),
+		limiter:  newLimiter(),
 	}
 }
 
+// SetMirror stores all charts and repository indexes which are loaded in the mirror at dir
+func (r *Runner) SetMirror(dir string) {
+	r.mirror = &mirror{dir: dir}
+	r.offline = false
+}
+
+// SetOffline loads charts only from the mirror at dir, without network access
+func (r *Runner) SetOffline(dir string) {
+	r.mirror = &mirror{dir: dir}
+	r.offline = true
+}
+
+// SetCache keeps chart repository indexes, OCI tags and charts in dir across runs. Indexes and tags
+// are refreshed after ttl.
+func (r *Runner) SetCache(dir string, ttl time.Duration) {
+	r.cache = newCache(dir, ttl, getter.All(r.settings), r.limiter)
+}
+
+// SetLock pins the chart versions of HelmReleases locked in l and records all others in it
+func (r *Runner) SetLock(l *Lock) {
+	r.locked = l
+}
+
+// SetTimeout aborts rendering a chart, including fetching it, after d. Zero means no timeout.
+func (r *Runner) SetTimeout(d time.Duration) {
+	r.timeout = d
+}
+
+// SetLimits bounds the concurrency of rendering and requests to chart repositories
+func (r *Runner) SetLimits(l Limits) {
+	r.limiter.set(l)
+}
+
+// RenderStats returns how many charts were rendered and how many renders were reused because
+// an identical chart was rendered before
+func (r *Runner) RenderStats() (rendered, reused int) {
+	return r.memo.stats()
+}
+
 func (r *Runner) RenderCharts(ctx context.Context, releases []RenderTask) (resmap.ResMap, error) {
+	return r.renderCharts(ctx, releases, false)
+}
+
+// renderCharts renders releases concurrently. If partial is set, failed releases are skipped
+// and their error is stored in the task, unless ctx is done.
+func (r *Runner) renderCharts(ctx context.Context, releases []RenderTask, partial bool) (resmap.ResMap, error) {
 	res := resmap.New()
 	g, ctx := errgroup.WithContext(ctx)
 
 	results := make([]resmap.ResMap, len(releases))
-	for i, h := range releases {
+	for i := range releases {
 		i := i
-		h := h
+		h := &releases[i]
 		g.Go(func() error {
-			r, err := r.renderChart(ctx, &h)
+			r, err := r.renderChartTimeout(ctx, h)
+			if err != nil && partial && ctx.Err() == nil {
+				h.err = err
+				return nil
+			}
 			if err != nil {
 				return err
 			}
@@ -76,27 +172,133 @@ func (r *Runner) RenderCharts(ctx context.Context, releases []RenderTask) (resma
 	return res, nil
 }
 
+// renderChartTimeout renders t within the timeout of the runner. As Helm does not support
+// cancellation, it returns as soon as ctx is done and leaves the render to finish in the background.
+// The render works on a copy of t, which is discarded if it is abandoned, and keeps its worker slot
+// until it returns.
+func (r *Runner) renderChartTimeout(ctx context.Context, t *RenderTask) (resmap.ResMap, error) {
+	release, err := r.limiter.worker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	type result struct {
+		rm  resmap.ResMap
+		err error
+	}
+	done := make(chan result, 1)
+	task := *t
+	untrack := r.track()
+	go func() {
+		defer untrack()
+		defer release()
+		rm, err := r.renderChart(ctx, &task)
+		done <- result{rm, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err == nil || ctx.Err() == nil {
+			*t = task
+			return res.rm, res.err
+		}
+		err = res.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if r.timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("HelmRelease %s timed out after %s: %w", t.release, r.timeout, err)
+	}
+	return nil, fmt.Errorf("HelmRelease %s: %w", t.release, err)
+}
+
 func (r *Runner) renderChart(ctx context.Context, t *RenderTask) (resmap.ResMap, error) {
+	if err := r.initHome(); err != nil {
+		return nil, err
+	}
 	cfg := new(action.Configuration)
-	cfg.Init(r.settings.RESTClientGetter(), t.namespace, os.Getenv("HELM_DRIVER"), func(format string, args ...interface{}) {
+	cfg.Init(r.settings.RESTClientGetter(), t.storageNamespace, os.Getenv("HELM_DRIVER"), func(format string, args ...interface{}) {
 		r.logger.Info(fmt.Sprintf(format, args...))
 	})
 
+	var registryConfig string
+	if t.tls != nil || t.repo.Username != "" {
+		dir, err := os.MkdirTemp("", "flux-helm-preview-credentials-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		if registryConfig, err = t.writeCredentials(dir); err != nil {
+			return nil, fmt.Errorf("error writing credentials: %w", err)
+		}
+	}
+
+	if t.ociRef() != "" || t.source != nil {
+		client, err := r.getRegistryClient(registryConfig)
+		if err != nil {
+			return nil, fmt.Errorf("error creating registry client: %w", err)
+		}
+		cfg.RegistryClient = client
+	}
+
 	install := action.NewInstall(cfg)
 	install.DryRun = true
 	install.ClientOnly = true
 	install.CreateNamespace = t.createNamespace
 	install.ReleaseName = t.releaseName
+	install.Namespace = t.namespace
 	install.SkipCRDs = t.skipCRDs
 	install.Replace = t.replace
 	install.DisableHooks = t.disableHooks
 	install.APIVersions = []string{}
+	if t.capabilities != nil {
+		install.KubeVersion = t.capabilities.KubeVersion
+		install.APIVersions = t.capabilities.APIVersions
+	}
 	install.IncludeCRDs = t.includeCRDs
+	install.PostRenderer = t.postRenderer
 
-	if err := r.getAndUpdateRepo(&t.repo); err != nil {
-		return nil, err
+	if t.source != nil {
+		path := filepath.Join(t.source.Path, t.chart)
+		chart, err := loadLocalChart(t.source.FS, path)
+		if err != nil {
+			return nil, fmt.Errorf("error loading chart: %w", err)
+		}
+		if err := r.buildDependencies(ctx, install, cfg.RegistryClient, t.source.FS, path, chart); err != nil {
+			return nil, fmt.Errorf("error building dependencies of chart '%s': %w", t.chart, err)
+		}
+		r.logger.Info("Loaded chart from source", "chart", t.chart, "path", t.source.Path)
+		return r.run(ctx, install, chart, t)
+	}
+
+	if t.digest == "" {
+		t.resolution = &Resolution{Release: t.release, Repository: t.repo.URL, Chart: t.chart, Constraint: t.constraint()}
+		if locked, ok := r.locked.pin(*t.resolution); ok && t.tag == "" {
+			r.logger.Info("Using locked chart version", "release", t.release, "chart", t.chart, "version", locked.Version)
+			t.version = locked.Version
+		}
 	}
 	install.ChartPathOptions.Version = t.version
+	if ref := t.ociRef(); ref != "" {
+		chart, err := r.pullChart(ctx, install, cfg.RegistryClient, ref, t)
+		if err != nil {
+			return nil, err
+		}
+		return r.run(ctx, install, chart, t)
+	}
+
+	if r.offline {
+		chart, err := r.mirror.repoChart(t.repo.URL, t.chart, t.version)
+		if err != nil {
+			return nil, err
+		}
+		r.logger.Info("Loaded chart from mirror", "chart", t.chart, "repo", t.repo.URL)
+		return r.run(ctx, install, chart, t)
+	}
+
 	install.ChartPathOptions.RepoURL = t.repo.URL
 	install.ChartPathOptions.Username = t.repo.Username
 	install.ChartPathOptions.Password = t.repo.Password
@@ -106,17 +308,191 @@ func (r *Runner) renderChart(ctx context.Context, t *RenderTask) (resmap.ResMap,
 	install.ChartPathOptions.PassCredentialsAll = t.repo.PassCredentialsAll
 	install.ChartPathOptions.KeyFile = t.repo.KeyFile
 
-	r.settings.Debug = true
+	chart, err := r.locateRepoChart(ctx, install.ChartPathOptions, &t.repo, t.chart)
+	if err != nil {
+		return nil, err
+	}
+	return r.run(ctx, install, chart, t)
+}
+
+// locateRepoChart loads chart name matching opts.Version from the chart repository of entry, from
+// the cache if it is configured
+func (r *Runner) locateRepoChart(ctx context.Context, opts action.ChartPathOptions, entry *repo.Entry, name string) (*chart.Chart, error) {
+	var indexPath, cp string
+	var err error
+	if r.cache != nil {
+		if indexPath, err = r.cache.index(ctx, entry); err != nil {
+			return nil, err
+		}
+		if cp, err = r.cache.repoChart(ctx, entry, indexPath, name, opts.Version); err != nil {
+			return nil, err
+		}
+	} else {
+		if indexPath, err = r.getAndUpdateRepo(ctx, entry); err != nil {
+			return nil, err
+		}
+		err = r.limiter.fetch(ctx, entry.URL, func() (err error) {
+			cp, err = opts.LocateChart(name, r.settings)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error locating chart: %w", err)
+		}
+	}
+	r.logger.Info("Loaded chart from repo", "chart", name, "repo", entry.URL, "path", cp)
+	ch, err := loader.Load(cp)
+	if err != nil {
+		return nil, err
+	}
+	if r.mirror != nil {
+		if err := r.mirror.storeRepoChart(entry.URL, indexPath, cp, ch); err != nil {
+			return nil, fmt.Errorf("error mirroring chart '%s': %w", name, err)
+		}
+	}
+	return ch, nil
+}
+
+// ociRef returns the oci:// reference of the chart, or an empty string for charts not stored
+// in an OCI registry
+func (t *RenderTask) ociRef() string {
+	if registry.IsOCI(t.repo.URL) {
+		return strings.TrimSuffix(t.repo.URL, "/") + "/" + t.chart
+	}
+	if registry.IsOCI(t.chart) {
+		return t.chart
+	}
+	return ""
+}
+
+// pullChart pulls a chart from an OCI registry. Versions are resolved by Helm, tags and digests
+// are pulled directly as Helm only supports semver tags.
+func (r *Runner) pullChart(ctx context.Context, install *action.Install, client *registry.Client, ref string, t *RenderTask) (*chart.Chart, error) {
+	if r.offline {
+		r.logger.Info("Loading chart from mirror", "chart", ref)
+		return r.mirror.ociChart(ref, t.version, t.tag, t.digest)
+	}
+	if t.digest == "" && t.tag == "" {
+		return r.locateOCIChart(ctx, install.ChartPathOptions, client, ref)
+	}
+	if t.digest != "" && r.cache != nil {
+		cp, _, err := r.cache.ociChart(ctx, client, ref, "", t.digest)
+		if err != nil {
+			return nil, err
+		}
+		return r.loadOCIChart(ref, t.digest, cp)
+	}
 
-	cp, err := install.ChartPathOptions.LocateChart(t.chart, r.settings)
+	ref = strings.TrimPrefix(ref, fmt.Sprintf("%s://", registry.OCIScheme))
+	if t.digest != "" {
+		ref += "@" + t.digest
+	} else {
+		ref += ":" + t.tag
+	}
+	var result *registry.PullResult
+	err := r.limiter.fetch(ctx, ref, func() (err error) {
+		result, err = client.Pull(ref)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error pulling chart '%s': %w", ref, err)
+	}
+	r.logger.Info("Loaded chart from registry", "chart", ref, "digest", result.Manifest.Digest)
+	if r.mirror != nil {
+		version := t.tag
+		if t.digest != "" {
+			version = t.digest
+		}
+		if err := r.mirror.storeOCIChart(t.ociRef(), version, result.Chart.Data); err != nil {
+			return nil, fmt.Errorf("error mirroring chart '%s': %w", ref, err)
+		}
+	}
+	return loader.LoadArchive(bytes.NewReader(result.Chart.Data))
+}
+
+// locateOCIChart loads the chart at the oci:// reference with the highest version matching the constraint
+func (r *Runner) locateOCIChart(ctx context.Context, opts action.ChartPathOptions, client *registry.Client, ref string) (*chart.Chart, error) {
+	if r.cache != nil {
+		cp, version, err := r.cache.ociChart(ctx, client, ref, opts.Version, "")
+		if err != nil {
+			return nil, err
+		}
+		return r.loadOCIChart(ref, version, cp)
+	}
+	var cp string
+	err := r.limiter.fetch(ctx, ref, func() (err error) {
+		cp, err = opts.LocateChart(ref, r.settings)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error locating chart: %w", err)
 	}
-	r.logger.Info("Loaded chart from repo", "chart", t.chart, "repo", t.repo.Name, "repo", t.repo.URL, "path", cp)
-	chart, err := loader.Load(cp)
+	ch, err := loader.Load(cp)
 	if err != nil {
 		return nil, err
 	}
+	return r.loadOCIChart(ref, ch.Metadata.Version, cp)
+}
+
+// loadOCIChart loads the archive of the chart at the oci:// reference and stores it in the mirror
+// under its version or digest
+func (r *Runner) loadOCIChart(ref, version, path string) (*chart.Chart, error) {
+	r.logger.Info("Loaded chart from registry", "chart", ref, "version", version, "path", path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if r.mirror != nil {
+		if err := r.mirror.storeOCIChart(ref, version, data); err != nil {
+			return nil, fmt.Errorf("error mirroring chart '%s': %w", ref, err)
+		}
+	}
+	return loader.LoadArchive(bytes.NewReader(data))
+}
+
+// constraint returns the version range or tag of the chart
+func (t *RenderTask) constraint() string {
+	if t.tag != "" {
+		return t.tag
+	}
+	return t.version
+}
+
+// run records the resolved chart version and renders the chart, unless the render was abandoned
+func (r *Runner) run(ctx context.Context, install *action.Install, chart *chart.Chart, t *RenderTask) (resmap.ResMap, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if t.resolution != nil {
+		t.resolution.Version = chart.Metadata.Version
+		t.resolution.Digest = chartDigest(chart)
+		if t.resolution.IsRange() {
+			r.logger.Info("Resolved chart version", "release", t.release, "chart", t.chart, "constraint", t.resolution.Constraint, "version", t.resolution.Version)
+		}
+		record := r.locked.record
+		if t.lockReadOnly {
+			record = r.locked.verify
+		}
+		if err := record(*t.resolution); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.mergeValuesFiles(chart); err != nil {
+		return nil, err
+	}
+	key, err := renderKey(chart, t)
+	if err != nil {
+		return nil, err
+	}
+	rm, reused, err := r.memo.do(key, func() (resmap.ResMap, error) {
+		return r.render(install, chart, t)
+	})
+	if reused && err == nil {
+		r.logger.Info("Reusing rendered chart", "release", t.releaseName, "namespace", t.namespace, "chart", chart.Name(), "version", chart.Metadata.Version)
+	}
+	return rm, err
+}
+
+func (r *Runner) render(install *action.Install, chart *chart.Chart, t *RenderTask) (resmap.ResMap, error) {
 	out := new(bytes.Buffer)
 	rel, err := install.Run(chart, t.values)
 	if err != nil {
@@ -132,39 +508,107 @@ func (r *Runner) renderChart(ctx context.Context, t *RenderTask) (resmap.ResMap,
 		}
 		fmt.Fprintf(out, "%s", manifests.String())
 	}
-	return resmap.NewFactory(resource.NewFactory(&hasher.Hasher{})).NewResMapFromBytes(out.Bytes())
+	rm, err := resmap.NewFactory(resource.NewFactory(&hasher.Hasher{})).NewResMapFromBytes(out.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := setDefaultNamespace(rm, t.namespace); err != nil {
+		return nil, err
+	}
+	if install.IncludeCRDs {
+		if err := markChartCRDs(rm, chart); err != nil {
+			return nil, err
+		}
+	}
+	return rm, nil
+}
+
+// setDefaultNamespace sets namespace on all namespaced objects without one, like Helm does
+// when applying them. Objects of unknown kinds are namespaced unless a CRD in rm says otherwise.
+func setDefaultNamespace(rm resmap.ResMap, namespace string) error {
+	clusterScoped := map[string]bool{}
+	for _, res := range rm.Resources() {
+		if res.GetKind() != "CustomResourceDefinition" {
+			continue
+		}
+		m, err := res.Map()
+		if err != nil {
+			return err
+		}
+		spec, _ := m["spec"].(map[string]interface{})
+		names, _ := spec["names"].(map[string]interface{})
+		if spec["scope"] == "Cluster" {
+			clusterScoped[fmt.Sprintf("%v/%v", spec["group"], names["kind"])] = true
+		}
+	}
+	for _, res := range rm.Resources() {
+		gvk := res.GetGvk()
+		if res.GetNamespace() != "" || gvk.IsClusterScoped() || clusterScoped[gvk.Group+"/"+gvk.Kind] {
+			continue
+		}
+		if err := res.SetNamespace(namespace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRegistryClient returns the client for OCI registries, using the credentials of the registry config.
+// A separate client is created for credentialsFile if it is set.
+func (r *Runner) getRegistryClient(credentialsFile string) (*registry.Client, error) {
+	if credentialsFile != "" {
+		return registry.NewClient(
+			registry.ClientOptCredentialsFile(credentialsFile),
+			registry.ClientOptWriter(NewLogWriter(r.logger)),
+		)
+	}
+	r.registryOnce.Do(func() {
+		r.registryClient, r.registryErr = registry.NewClient(
+			registry.ClientOptCredentialsFile(r.settings.RegistryConfig),
+			registry.ClientOptWriter(NewLogWriter(r.logger)),
+		)
+	})
+	return r.registryClient, r.registryErr
 }
 
-func (r *Runner) getAndUpdateRepo(entry *repo.Entry) error {
-	_, ok := r.repos.Load(entry.URL)
-	if ok {
-		return nil
+// getAndUpdateRepo downloads the index of the chart repository once per run and returns its path
+func (r *Runner) getAndUpdateRepo(ctx context.Context, entry *repo.Entry) (string, error) {
+	if indexPath, ok := r.repos.Load(entry.URL); ok {
+		return indexPath.(string), nil
 	}
 
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	_, ok = r.repos.Load(entry.URL)
-	if ok {
-		return nil
+	if indexPath, ok := r.repos.Load(entry.URL); ok {
+		return indexPath.(string), nil
 	}
 
 	chartRepo, err := repo.NewChartRepository(entry, getter.All(r.settings))
 	if err != nil {
-		return err
+		return "", err
 	}
 	chartRepo.CachePath = r.settings.RepositoryCache
-	_, err = chartRepo.DownloadIndexFile()
-	if err != nil {
+	var indexPath string
+	err = r.limiter.fetch(ctx, entry.URL, func() (err error) {
+		indexPath, err = chartRepo.DownloadIndexFile()
 		return err
+	})
+	if err != nil {
+		return "", err
 	}
 	if r.storage.Has(entry.Name) {
-		return nil
+		r.repos.Store(entry.URL, indexPath)
+		return indexPath, nil
 	}
-	r.storage.Update(entry)
-	err = r.storage.WriteFile(r.settings.RegistryConfig, 0o644)
+	// credentials are never persisted
+	stored := *entry
+	stored.Username, stored.Password = "", ""
+	stored.CAFile, stored.CertFile, stored.KeyFile = "", "", ""
+	r.storage.Update(&stored)
+	err = r.storage.WriteFile(r.settings.RepositoryConfig, 0o644)
 	if err != nil {
-		return err
+		return "", err
 	}
-	r.repos.Store(entry.URL, true) // TODO
-	return nil
+	r.repos.Store(entry.URL, indexPath)
+	return indexPath, nil
 }
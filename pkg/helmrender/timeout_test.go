@@ -0,0 +1,54 @@
+package helmrender_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
+)
+
+func TestRenderTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	renderHanging := func(ctx context.Context, timeout time.Duration) error {
+		fs := limitsRepo(t, srv.URL, "1.x")
+		r := render.NewDefaultRender(logr.Discard())
+		if err := r.AddKustomization(fs, "/repo"); err != nil {
+			t.Fatal(err)
+		}
+		m, _ := sources.New(sources.Config{}, "")
+		runner := helmrender.NewRunner(testSettings(t), logr.Discard())
+		defer runner.Close()
+		runner.SetTimeout(timeout)
+		repo, err := helmrender.ParseHelmRepo(r, runner, m.WithSelf(sources.Location{FS: fs, Path: "/"}), logr.Discard())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repo.RenderAllCharts(ctx)
+		return err
+	}
+
+	err := renderHanging(context.Background(), 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") || !strings.Contains(err.Error(), "HelmRelease default/demo-") {
+		t.Errorf("expected a timeout naming the release, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := renderHanging(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected rendering to be canceled, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package helmrender_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func valuesFs(t *testing.T, valuesFrom string, extra map[string]string) filesys.FileSystem {
+	fs := filesys.MakeFsInMemory()
+	files := map[string]string{
+		"/clusters/prod/release.yaml": `apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: app
+  namespace: default
+spec:
+  chart:
+    spec:
+      chart: ./charts/app
+      sourceRef:
+        kind: GitRepository
+        name: flux-system
+        namespace: flux-system
+  valuesFrom:
+` + valuesFrom,
+		"/charts/app/Chart.yaml":        "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"/charts/app/values.yaml":       "message: default\n",
+		"/charts/app/templates/cm.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  message: {{ .Values.message }}\n",
+	}
+	for p, c := range extra {
+		files[p] = c
+	}
+	for p, c := range files {
+		if err := fs.WriteFile(p, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+func TestValuesFromOptional(t *testing.T) {
+	present := map[string]string{"/clusters/prod/values.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: values\n  namespace: default\ndata:\n  values.yaml: 'message: from-configmap'\n"}
+	tests := []struct {
+		name       string
+		valuesFrom string
+		extra      map[string]string
+		lenient    bool
+		want       string
+		err        string
+	}{
+		{"present", "  - kind: ConfigMap\n    name: values\n", present, false, "message: from-configmap", ""},
+		{"missing", "  - kind: ConfigMap\n    name: values\n", nil, false, "", "ConfigMap 'default/values' not found"},
+		{"missing key", "  - kind: ConfigMap\n    name: values\n    valuesKey: other.yaml\n", present, false, "", "missing key 'other.yaml' in ConfigMap 'default/values'"},
+		{"optional", "  - kind: Secret\n    name: values\n    optional: true\n", nil, false, "message: default", ""},
+		{"lenient", "  - kind: Secret\n    name: values\n", nil, true, "message: default", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := renderRepo(t, valuesFs(t, tt.valuesFrom, tt.extra), "/clusters/prod", testSettings(t), func(r *helmrender.HelmRepo) {
+				r.SetLenientValues(tt.lenient)
+			})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("expected %q in rendered chart:\n%s", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestValuesFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files string
+		want  []string
+		err   string
+	}{
+		{"merged", "      valuesFiles:\n      - charts/app/values.yaml\n      - ./values/prod.yaml\n", []string{"message: prod", "level: info"}, ""},
+		{"over defaults", "      valuesFiles:\n      - values/prod.yaml\n", []string{"message: prod", "level: info"}, ""},
+		{"missing", "      valuesFiles:\n      - values/staging.yaml\n", nil, "values file 'values/staging.yaml' not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := valuesFs(t, "", map[string]string{
+				"/charts/app/values.yaml":       "message: default\nlevel: info\n",
+				"/charts/app/templates/cm.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  message: {{ .Values.message }}\n  level: {{ .Values.level | default \"unset\" }}\n",
+				"/values/prod.yaml":             "message: prod\n",
+			})
+			release, _ := fs.ReadFile("/clusters/prod/release.yaml")
+			release = []byte(strings.Replace(string(release), "        namespace: flux-system\n", "        namespace: flux-system\n"+tt.files, 1))
+			if err := fs.WriteFile("/clusters/prod/release.yaml", release); err != nil {
+				t.Fatal(err)
+			}
+			out, err := renderRepo(t, fs, "/clusters/prod", testSettings(t))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("expected %q in rendered chart:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
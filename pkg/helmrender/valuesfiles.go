@@ -0,0 +1,61 @@
+package helmrender
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/fluxcd/pkg/runtime/transform"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// valuesFiles returns the values files of a chart spec, the deprecated single file goes first
+// like in source-controller
+func valuesFiles(files []string, file string) []string {
+	if file == "" {
+		return files
+	}
+	return append([]string{file}, files...)
+}
+
+// mergeValuesFiles merges the values files of t over the default values of ch, so that they
+// take precedence over chart defaults but not over valuesFrom and inline values. Files of
+// charts from Git or Bucket sources are relative to the source root, others to the chart root.
+func (t *RenderTask) mergeValuesFiles(ch *chart.Chart) error {
+	if len(t.valuesFiles) == 0 {
+		return nil
+	}
+	merged := ch.Values
+	for _, f := range t.valuesFiles {
+		var data []byte
+		if t.source != nil {
+			p := filepath.Join(t.source.Path, f)
+			if !t.source.FS.Exists(p) {
+				return fmt.Errorf("values file '%s' not found in source", f)
+			}
+			content, err := t.source.FS.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			data = content
+		} else {
+			name := path.Clean(f)
+			for _, raw := range ch.Raw {
+				if raw.Name == name {
+					data = raw.Data
+				}
+			}
+			if data == nil {
+				return fmt.Errorf("values file '%s' not found in chart %s", f, ch.Name())
+			}
+		}
+		values, err := chartutil.ReadValues(data)
+		if err != nil {
+			return fmt.Errorf("error reading values file '%s': %w", f, err)
+		}
+		merged = transform.MergeMaps(merged, values)
+	}
+	ch.Values = merged
+	return nil
+}
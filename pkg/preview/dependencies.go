@@ -0,0 +1,49 @@
+package preview
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tobiash/flux-helm-preview/pkg/graph"
+)
+
+// DependencyError is a missing or cyclic dependency of a Flux Kustomization or HelmRelease on
+// one side of a diff
+type DependencyError struct {
+	// Side is A or B
+	Side    string
+	Problem string
+}
+
+func (e DependencyError) String() string {
+	return e.Side + ": " + e.Problem
+}
+
+// dependencyErrors lists the dependency problems of both sides
+func dependencyErrors(a, b *graph.Graph) []DependencyError {
+	var errs []DependencyError
+	for _, side := range []struct {
+		name  string
+		graph *graph.Graph
+	}{{"A", a}, {"B", b}} {
+		for _, problem := range side.graph.Problems() {
+			errs = append(errs, DependencyError{Side: side.name, Problem: problem})
+		}
+	}
+	return errs
+}
+
+func writeDependencyErrors(out io.Writer, errs []DependencyError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(out, "# dependency errors"); err != nil {
+		return err
+	}
+	for _, e := range errs {
+		if _, err := fmt.Fprintln(out, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package preview
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+)
+
+// renderInfo collects what is known about rendering one side besides the rendered objects. All
+// methods may be called on a nil renderInfo.
+type renderInfo struct {
+	versions   chartVersions
+	failures   map[string][]render.Failure
+	unitErrors map[string]error
+	// base is set for side A of a diff, whose chart versions are not recorded in the lock
+	base bool
+}
+
+func newRenderInfo() *renderInfo {
+	return &renderInfo{
+		versions:   chartVersions{},
+		failures:   map[string][]render.Failure{},
+		unitErrors: map[string]error{},
+	}
+}
+
+func (i *renderInfo) addVersions(unit string, versions []helmrender.Resolution) {
+	if i != nil {
+		i.versions[unit] = versions
+	}
+}
+
+func (i *renderInfo) addFailures(unit string, failures []render.Failure) {
+	if i != nil && len(failures) > 0 {
+		i.failures[unit] = append(i.failures[unit], failures...)
+	}
+}
+
+func (i *renderInfo) isBase() bool {
+	return i != nil && i.base
+}
+
+func (i *renderInfo) unitFailed(unit string, err error) {
+	if i != nil {
+		i.unitErrors[unit] = err
+	}
+}
+
+// RenderError is a HelmRelease, Flux Kustomization or unit which failed to render on one side
+// of a diff
+type RenderError struct {
+	// Side is A or B
+	Side string
+	Unit string
+	// Object is the failed HelmRelease or Kustomization, empty if the whole unit failed
+	Object string
+	Err    error
+}
+
+func (e RenderError) String() string {
+	parts := []string{e.Side}
+	for _, p := range []string{e.Unit, e.Object} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(append(parts, strings.Join(strings.Fields(e.Err.Error()), " ")), ": ")
+}
+
+// renderErrors lists the failures of both sides
+func renderErrors(a, b *renderInfo) []RenderError {
+	var errs []RenderError
+	for _, side := range []struct {
+		name string
+		info *renderInfo
+	}{{"A", a}, {"B", b}} {
+		for unit, err := range side.info.unitErrors {
+			errs = append(errs, RenderError{Side: side.name, Unit: unit, Err: err})
+		}
+		for unit, failures := range side.info.failures {
+			for _, f := range failures {
+				errs = append(errs, RenderError{
+					Side:   side.name,
+					Unit:   unit,
+					Object: fmt.Sprintf("%s %s/%s", f.Kind, f.Namespace, f.Name),
+					Err:    f.Err,
+				})
+			}
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].String() < errs[j].String() })
+	return errs
+}
+
+func writeRenderErrors(out io.Writer, errs []RenderError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(out, "# render errors, objects of failed releases and kustomizations are not diffed"); err != nil {
+		return err
+	}
+	for _, e := range errs {
+		if _, err := fmt.Fprintln(out, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,17 +1,30 @@
 package preview
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/capabilities"
+	"github.com/tobiash/flux-helm-preview/pkg/credentials"
 	"github.com/tobiash/flux-helm-preview/pkg/diff"
+	"github.com/tobiash/flux-helm-preview/pkg/discover"
 	"github.com/tobiash/flux-helm-preview/pkg/filter"
+	"github.com/tobiash/flux-helm-preview/pkg/fluxkustomize"
+	"github.com/tobiash/flux-helm-preview/pkg/gitfs"
+	"github.com/tobiash/flux-helm-preview/pkg/graph"
 	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
 	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"github.com/tobiash/flux-helm-preview/pkg/sops"
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v3"
 	helmcli "helm.sh/helm/v3/pkg/cli"
@@ -20,34 +33,138 @@ import (
 
 type Preview struct {
 	kustomizations []string
+	discovery      *discover.Options
+	flux           bool
+	sources        *sources.Map
+	capabilities   *capabilities.Profiles
+	credentials    *credentials.Credentials
+	lenientValues  bool
+	fixturesPath   string
+	fixtures       *render.Render
+	decryptor      *sops.Decryptor
+	masker         *sops.Masker
 	filters        *filter.FilterConfig
 	helmsettings   *helmcli.EnvSettings
 	helmrunner     *helmrender.Runner
+	mirrorDir      string
+	offline        bool
+	cacheDir       string
+	cacheTTL       time.Duration
+	limits         helmrender.Limits
+	helmConfig     helmrender.HelmConfig
+	lockFile       string
+	lock           *helmrender.Lock
 	log            logr.Logger
 	ctx            context.Context
+	timeout        time.Duration
+	chartTimeout   time.Duration
+	partial        bool
 }
 
-func (p *Preview) loadRepo(path string) (*render.Render, error) {
-	r := render.NewDefaultRender(p.log.WithValues("renderPath", path))
-	for _, k := range p.kustomizations {
-		err := r.AddKustomization(filesys.MakeFsOnDisk(), filepath.Join(path, k))
+// units returns the kustomization paths to render for each unit of the repository at path.
+// Explicitly configured kustomizations form one unnamed unit, every discovered root is a unit of its own.
+func (p *Preview) units(fSys filesys.FileSystem, path string) (map[string][]string, error) {
+	units := map[string][]string{}
+	if len(p.kustomizations) > 0 {
+		units[""] = p.kustomizations
+	}
+	if p.discovery != nil {
+		found, err := discover.Discover(fSys, path, *p.discovery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover kustomizations: %w", err)
+		}
+		p.log.Info("discovered kustomizations", "path", path, "kustomizations", found)
+		for _, k := range found {
+			units[k] = []string{k}
+		}
+	}
+	return units, nil
+}
+
+// loadRepo renders all units of the repository at path. Chart versions and failures are added to
+// info unless it is nil. When rendering partially, failed units are skipped.
+func (p *Preview) loadRepo(ctx context.Context, fSys filesys.FileSystem, path string, info *renderInfo) (map[string]*render.Render, error) {
+	units, err := p.units(fSys, path)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*render.Render, len(units))
+	for name, kustomizations := range units {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		r, err := p.loadUnit(ctx, fSys, path, name, kustomizations, info)
+		if err != nil && p.partial && ctx.Err() == nil {
+			p.log.Error(err, "skipping unit", "unit", name)
+			info.unitFailed(name, err)
+			continue
+		}
+		if err != nil {
+			if name != "" {
+				return nil, fmt.Errorf("failed to render %s: %w", name, err)
+			}
+			return nil, err
+		}
+		result[name] = r
+	}
+	return result, nil
+}
+
+func (p *Preview) loadUnit(ctx context.Context, fSys filesys.FileSystem, path, name string, kustomizations []string, info *renderInfo) (*render.Render, error) {
+	r := render.NewDefaultRender(p.log.WithValues("renderPath", path, "unit", name))
+	r.SetDecryptor(p.decryptor)
+	if p.fixtures != nil {
+		r.SetFixtures(p.fixtures.ResMap)
+	}
+	for _, k := range kustomizations {
+		err := r.AddKustomization(fSys, filepath.Join(path, k))
 		if err != nil {
 			return nil, fmt.Errorf("failed to add kustomization: %w", err)
 		}
 	}
 
+	resolver := p.sources.WithSelf(sources.Location{FS: fSys, Path: path})
+	if p.flux && p.partial {
+		failures, err := fluxkustomize.RenderAllPartial(r, resolver, p.log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render flux kustomizations: %w", err)
+		}
+		info.addFailures(name, failures)
+	} else if p.flux {
+		if err := fluxkustomize.RenderAll(r, resolver, p.log); err != nil {
+			return nil, fmt.Errorf("failed to render flux kustomizations: %w", err)
+		}
+	}
+
 	if p.helmrunner != nil {
-		helm, err := helmrender.ParseHelmRepo(r, p.helmrunner, p.log)
+		helm, err := helmrender.ParseHelmRepo(r, p.helmrunner, resolver, p.log)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse helm repo: %w", err)
 		}
-		rc, err := helm.RenderAllCharts()
+		profile := name
+		if profile == "" && len(kustomizations) == 1 {
+			profile = kustomizations[0]
+		}
+		helm.SetCapabilities(p.capabilities.For(profile))
+		helm.SetCredentials(p.credentials)
+		helm.SetLenientValues(p.lenientValues)
+		helm.SetPartial(p.partial)
+		helm.SetLockReadOnly(info.isBase())
+		rc, err := helm.RenderAllCharts(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("failed to render helm charts: %w", err)
 		}
 		if err = r.AppendAll(rc); err != nil {
 			return nil, err
 		}
+		info.addVersions(name, helm.Resolutions())
+		info.addFailures(name, helm.Failures())
+	}
+
+	for _, res := range r.Resources() {
+		if err := p.masker.Mask(res); err != nil {
+			return nil, err
+		}
 	}
 
 	if p.filters != nil {
@@ -61,26 +178,77 @@ func (p *Preview) loadRepo(path string) (*render.Render, error) {
 	return r, nil
 }
 
+func unitNames(renders ...map[string]*render.Render) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, r := range renders {
+		for name := range r {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close removes temporary files created while rendering
+func (p *Preview) Close() error {
+	if p.helmrunner != nil {
+		return p.helmrunner.Close()
+	}
+	return nil
+}
+
+// context returns the context of an operation, which is done after the global timeout
+func (p *Preview) context() (context.Context, context.CancelFunc) {
+	if p.timeout > 0 {
+		return context.WithTimeout(p.ctx, p.timeout)
+	}
+	return context.WithCancel(p.ctx)
+}
+
+// timeoutError adds the global timeout to err if ctx exceeded it
+func (p *Preview) timeoutError(ctx context.Context, err error) error {
+	if p.timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s: %w", p.timeout, err)
+	}
+	return err
+}
+
 func (p *Preview) Render(path string, out io.Writer) error {
-	r, err := p.loadRepo(path)
+	ctx, cancel := p.context()
+	defer cancel()
+	units, err := p.loadRepo(ctx, filesys.MakeFsOnDisk(), path, nil)
 	if err != nil {
-		return fmt.Errorf("error loading repo: %w", err)
+		return p.timeoutError(ctx, fmt.Errorf("error loading repo: %w", err))
 	}
-	yaml, err := r.AsYaml()
-	if err != nil {
-		return fmt.Errorf("error transforming to yaml: %w", err)
+	if err := p.writeLock(); err != nil {
+		return err
 	}
-	_, err = out.Write(yaml)
-	if err != nil {
-		fmt.Errorf("error writing output: %w", err)
+	for i, name := range unitNames(units) {
+		if err := helmrender.RemoveCRDMarkers(units[name]); err != nil {
+			return err
+		}
+		yaml, err := units[name].AsYaml()
+		if err != nil {
+			return fmt.Errorf("error transforming to yaml: %w", err)
+		}
+		if i > 0 {
+			yaml = append([]byte("---\n"), yaml...)
+		}
+		if _, err = out.Write(yaml); err != nil {
+			return fmt.Errorf("error writing output: %w", err)
+		}
 	}
 	return nil
 }
 
-func (a *Preview) renderFn(repo string, out **render.Render) func () error {
+func (p *Preview) renderFn(ctx context.Context, fSys filesys.FileSystem, repo string, out *map[string]*render.Render, info *renderInfo) func() error {
 	return func() error {
 		var err error
-		*out, err = a.loadRepo(repo)
+		*out, err = p.loadRepo(ctx, fSys, repo, info)
 		if err != nil {
 			return err
 		}
@@ -88,19 +256,138 @@ func (a *Preview) renderFn(repo string, out **render.Render) func () error {
 	}
 }
 
+// DiffResult holds information about a diff in addition to its textual output
+type DiffResult struct {
+	// GraphA and GraphB are the dependency graphs of both sides
+	GraphA, GraphB *graph.Graph
+	// RenderErrors are the failures of partial rendering
+	RenderErrors []RenderError
+	// DependencyErrors are the missing and cyclic dependencies of both sides
+	DependencyErrors []DependencyError
+}
+
+// DependenciesChanged reports whether the dependency graph differs between both sides
+func (r *DiffResult) DependenciesChanged() bool {
+	return !r.GraphA.Equal(r.GraphB)
+}
+
+func buildGraph(units map[string]*render.Render) (*graph.Graph, error) {
+	g := graph.New()
+	for _, name := range unitNames(units) {
+		if err := g.Add(name, units[name]); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Graph writes the dependency graph of Flux Kustomizations and HelmReleases in the given format.
+// If dependencies are missing or cyclic, the graph is still written and a graph.ValidationError
+// is returned.
+func (p *Preview) Graph(path string, format string, out io.Writer) error {
+	ctx, cancel := p.context()
+	defer cancel()
+	units, err := p.loadRepo(ctx, filesys.MakeFsOnDisk(), path, nil)
+	if err != nil {
+		return p.timeoutError(ctx, fmt.Errorf("error loading repo: %w", err))
+	}
+	g, err := buildGraph(units)
+	if err != nil {
+		return err
+	}
+	if err := g.Write(out, format); err != nil {
+		return err
+	}
+	return g.Validate()
+}
+
+func (p *Preview) Diff(a, b string, out io.Writer) (*DiffResult, error) {
+	return p.diff(filesys.MakeFsOnDisk(), a, filesys.MakeFsOnDisk(), b, out)
+}
+
+// DiffGit diffs two refs of the git repository at repo without checking them out
+func (p *Preview) DiffGit(repo, refA, refB string, out io.Writer) (*DiffResult, error) {
+	fsA, err := gitfs.New(repo, refA, p.log)
+	if err != nil {
+		return nil, err
+	}
+	fsB, err := gitfs.New(repo, refB, p.log)
+	if err != nil {
+		return nil, err
+	}
+	return p.diff(fsA, gitfs.Root, fsB, gitfs.Root, out)
+}
 
-func (p *Preview) Diff(a, b string, out io.Writer) error {
-	g, _ := errgroup.WithContext(p.ctx)
-	var ar, br *render.Render
-	g.Go(p.renderFn(a, &ar))
-	g.Go(p.renderFn(b, &br))
+func (p *Preview) diff(fsA filesys.FileSystem, a string, fsB filesys.FileSystem, b string, out io.Writer) (*DiffResult, error) {
+	ctx, cancel := p.context()
+	defer cancel()
+	g, gctx := errgroup.WithContext(ctx)
+	var ar, br map[string]*render.Render
+	ia, ib := newRenderInfo(), newRenderInfo()
+	ia.base = true
+	g.Go(p.renderFn(gctx, fsA, a, &ar, ia))
+	g.Go(p.renderFn(gctx, fsB, b, &br, ib))
 	if err := g.Wait(); err != nil {
-		return fmt.Errorf("render error: %w", err)
+		return nil, p.timeoutError(ctx, fmt.Errorf("render error: %w", err))
 	}
-	if err := diff.Diff(ar, br, out); err != nil {
-		return fmt.Errorf("diff error: %w", err)
+	if err := p.writeLock(); err != nil {
+		return nil, err
 	}
-	return nil
+	if p.helmrunner != nil {
+		rendered, reused := p.helmrunner.RenderStats()
+		p.log.Info("rendered charts", "rendered", rendered, "reused", reused)
+	}
+	var result DiffResult
+	var err error
+	if result.GraphA, err = buildGraph(ar); err != nil {
+		return nil, err
+	}
+	if result.GraphB, err = buildGraph(br); err != nil {
+		return nil, err
+	}
+	result.RenderErrors = renderErrors(ia, ib)
+	if err := writeRenderErrors(out, result.RenderErrors); err != nil {
+		return nil, fmt.Errorf("diff error: %w", err)
+	}
+	result.DependencyErrors = dependencyErrors(result.GraphA, result.GraphB)
+	if err := writeDependencyErrors(out, result.DependencyErrors); err != nil {
+		return nil, fmt.Errorf("diff error: %w", err)
+	}
+	if err := writeChartVersions(out, ia.versions, ib.versions); err != nil {
+		return nil, fmt.Errorf("diff error: %w", err)
+	}
+	for _, name := range unitNames(ar, br) {
+		if ia.unitErrors[name] != nil || ib.unitErrors[name] != nil {
+			continue
+		}
+		ua, ok := ar[name]
+		if !ok {
+			ua = render.NewDefaultRender(p.log)
+		}
+		ub, ok := br[name]
+		if !ok {
+			ub = render.NewDefaultRender(p.log)
+		}
+		for _, f := range append(ia.failures[name], ib.failures[name]...) {
+			for _, r := range []*render.Render{ua, ub} {
+				if err := r.RemoveFailed(f); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := helmrender.ApplyUpgradeCRDPolicies(ua, ub); err != nil {
+			return nil, fmt.Errorf("error applying CRD policies: %w", err)
+		}
+		for _, r := range []*render.Render{ua, ub} {
+			if err := helmrender.RemoveCRDMarkers(r); err != nil {
+				return nil, err
+			}
+		}
+		if err := diff.DiffUnit(name, ua, ub, out); err != nil {
+			return nil, fmt.Errorf("diff error: %w", err)
+		}
+	}
+	return &result, nil
 }
 
 type Opt func(p *Preview) error
@@ -112,15 +399,68 @@ func New(opts ...Opt) (*Preview, error) {
 			return nil, err
 		}
 	}
+	if len(p.kustomizations) == 0 && p.discovery == nil {
+		return nil, fmt.Errorf("either kustomizations or discovery must be configured")
+	}
+	if p.sources == nil {
+		p.sources, _ = sources.New(sources.Config{}, "")
+	}
+	p.masker = sops.NewMasker(p.decryptor)
+	if p.fixturesPath != "" {
+		p.fixtures = render.NewDefaultRender(p.log)
+		if err := p.fixtures.AddKustomization(filesys.MakeFsOnDisk(), p.fixturesPath); err != nil {
+			return nil, fmt.Errorf("failed to load fixtures: %w", err)
+		}
+	}
 	if p.helmsettings != nil {
 		p.helmrunner = helmrender.NewRunner(p.helmsettings, p.log)
+		p.helmrunner.SetLimits(p.limits)
+		p.helmrunner.UseHelmConfig(p.helmConfig)
+		p.helmrunner.SetLock(p.lock)
+		p.helmrunner.SetTimeout(p.chartTimeout)
+		if p.cacheDir != "" {
+			p.helmrunner.SetCache(p.cacheDir, p.cacheTTL)
+		}
+		if p.offline {
+			p.helmrunner.SetOffline(p.mirrorDir)
+		} else if p.mirrorDir != "" {
+			p.helmrunner.SetMirror(p.mirrorDir)
+		}
 	}
 	if p.ctx == nil {
-		p.ctx = context.TODO()
+		p.ctx = context.Background()
 	}
 	return &p, nil
 }
 
+// WithPartial continues rendering when HelmReleases, Flux Kustomizations or units fail to render.
+// Failures are reported in the diff instead, and the objects of failed releases and kustomizations
+// are left out of it.
+func WithPartial() Opt {
+	return func(p *Preview) error {
+		p.partial = true
+		return nil
+	}
+}
+
+// WithContext cancels rendering when ctx is done
+func WithContext(ctx context.Context) Opt {
+	return func(p *Preview) error {
+		p.ctx = ctx
+		return nil
+	}
+}
+
+// WithTimeout aborts rendering or diffing after d, and rendering a single chart after chart.
+// Zero durations mean no timeout.
+func WithTimeout(d, chart time.Duration) Opt {
+	return func(p *Preview) error {
+		p.timeout = d
+		p.chartTimeout = chart
+		return nil
+	}
+}
+
 func WithLogger(log logr.Logger) Opt {
 	return func(p *Preview) error {
 		p.log = log
@@ -141,7 +481,7 @@ func WithFilterFile(f *os.File) Opt {
 }
 
 func WithFilterYAML(f string) Opt {
-	return func (p *Preview) error {
+	return func(p *Preview) error {
 		m := &filter.FilterConfig{}
 		if err := yaml.Unmarshal([]byte(f), m); err != nil {
 			return err
@@ -158,9 +498,220 @@ func WithHelm(helmsettings *helmcli.EnvSettings) Opt {
 	}
 }
 
+// WithHelmConfig uses existing Helm configuration files instead of a private, temporary Helm home
+func WithHelmConfig(c helmrender.HelmConfig) Opt {
+	return func(p *Preview) error {
+		p.helmConfig = c
+		return nil
+	}
+}
+
+// WithLockFile pins the chart versions of HelmReleases to those in the lock file at path, and
+// writes the versions of releases which are not locked yet to it. In a diff, only the versions
+// of side b are written.
+func WithLockFile(path string) Opt {
+	return func(p *Preview) error {
+		p.lockFile = path
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			p.lock = helmrender.NewLock()
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		p.lock, err = helmrender.LoadLock(f)
+		return err
+	}
+}
+
+// writeLock updates the lock file if the chart versions used differ from the locked ones
+func (p *Preview) writeLock() error {
+	if p.lock == nil || !p.lock.Changed() {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := p.lock.Write(&buf); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p.lockFile, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("error writing lock file: %w", err)
+	}
+	return nil
+}
+
+// WithCache keeps chart repository indexes and charts in dir, which can be shared between runs.
+// Indexes are refreshed after ttl.
+func WithCache(dir string, ttl time.Duration) Opt {
+	return func(p *Preview) error {
+		p.cacheDir = dir
+		p.cacheTTL = ttl
+		return nil
+	}
+}
+
+// WithLimits bounds the number of charts rendered concurrently and of requests per chart
+// repository host, and sets how often transient request failures are retried
+func WithLimits(l helmrender.Limits) Opt {
+	return func(p *Preview) error {
+		p.limits = l
+		return nil
+	}
+}
+
+// WithMirror stores all charts and chart repository indexes loaded while rendering in dir
+func WithMirror(dir string) Opt {
+	return func(p *Preview) error {
+		p.mirrorDir = dir
+		p.offline = false
+		return nil
+	}
+}
+
+// WithOffline loads charts only from the mirror at dir, populated by WithMirror, without network access
+func WithOffline(dir string) Opt {
+	return func(p *Preview) error {
+		p.mirrorDir = dir
+		p.offline = true
+		return nil
+	}
+}
+
 func WithKustomizations(kustomizations []string) Opt {
 	return func(p *Preview) error {
 		p.kustomizations = append(p.kustomizations, kustomizations...)
 		return nil
 	}
 }
+
+// WithDiscovery renders every kustomization root found in the repository as a separate unit
+func WithDiscovery(opts discover.Options) Opt {
+	return func(p *Preview) error {
+		p.discovery = &opts
+		return nil
+	}
+}
+
+// WithFlux renders Flux Kustomization objects found in the repository
+func WithFlux() Opt {
+	return func(p *Preview) error {
+		p.flux = true
+		return nil
+	}
+}
+
+// WithSourceMapFile maps Flux sources to local paths, relative to the directory of f
+func WithSourceMapFile(f *os.File) Opt {
+	return func(p *Preview) error {
+		m, err := sources.Load(f, filepath.Dir(f.Name()))
+		if err != nil {
+			return err
+		}
+		p.sources = m
+		return nil
+	}
+}
+
+// WithSourceMapYAML maps Flux sources to local paths, relative to the working directory
+func WithSourceMapYAML(y string) Opt {
+	return func(p *Preview) error {
+		m, err := sources.Load(strings.NewReader(y), "")
+		if err != nil {
+			return err
+		}
+		p.sources = m
+		return nil
+	}
+}
+
+// WithAgeKeys decrypts SOPS encrypted resources referenced by HelmReleases and Flux Kustomizations.
+// Decrypted values flow into chart values and postBuild substitutions and so into the rendered
+// objects. The data of Secrets is masked in the output, decrypted values rendered into other
+// objects such as ConfigMaps are shown in plain text.
+func WithAgeKeys(keys io.Reader) Opt {
+	return func(p *Preview) error {
+		d, err := sops.NewDecryptor(keys)
+		if err != nil {
+			return err
+		}
+		p.decryptor = d
+		return nil
+	}
+}
+
+// WithFixtures loads the objects at path, which are visible to valuesFrom and substituteFrom lookups
+// but never part of the output. They stand in for objects created outside of the repository.
+func WithFixtures(path string) Opt {
+	return func(p *Preview) error {
+		p.fixturesPath = path
+		return nil
+	}
+}
+
+// WithLenientValues ignores missing valuesFrom references of HelmReleases, even if they are not optional
+func WithLenientValues() Opt {
+	return func(p *Preview) error {
+		p.lenientValues = true
+		return nil
+	}
+}
+
+// WithCapabilities sets the Kubernetes version and API versions charts are rendered with
+func WithCapabilities(cfg capabilities.Config) Opt {
+	return func(p *Preview) error {
+		c, err := capabilities.New(cfg, "")
+		if err != nil {
+			return err
+		}
+		p.capabilities = c
+		return nil
+	}
+}
+
+// WithCapabilitiesFile reads per-cluster capability profiles, relative to the directory of f
+func WithCapabilitiesFile(f *os.File) Opt {
+	return func(p *Preview) error {
+		c, err := capabilities.Load(f, filepath.Dir(f.Name()))
+		if err != nil {
+			return err
+		}
+		p.capabilities = c
+		return nil
+	}
+}
+
+// WithCapabilitiesYAML reads per-cluster capability profiles, relative to the working directory
+func WithCapabilitiesYAML(y string) Opt {
+	return func(p *Preview) error {
+		c, err := capabilities.Load(strings.NewReader(y), "")
+		if err != nil {
+			return err
+		}
+		p.capabilities = c
+		return nil
+	}
+}
+
+// WithCredentialsFile reads chart repository credentials, relative to the directory of f
+func WithCredentialsFile(f *os.File) Opt {
+	return func(p *Preview) error {
+		c, err := credentials.Load(f, filepath.Dir(f.Name()))
+		if err != nil {
+			return err
+		}
+		p.credentials = c
+		return nil
+	}
+}
+
+// WithCredentialsYAML reads chart repository credentials, relative to the working directory
+func WithCredentialsYAML(y string) Opt {
+	return func(p *Preview) error {
+		c, err := credentials.Load(strings.NewReader(y), "")
+		if err != nil {
+			return err
+		}
+		p.credentials = c
+		return nil
+	}
+}
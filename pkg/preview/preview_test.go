@@ -0,0 +1,99 @@
+package preview_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/graph"
+	"github.com/tobiash/flux-helm-preview/pkg/preview"
+)
+
+func TestDiffGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	commit := func(value string) {
+		files := map[string]string{
+			"app/kustomization.yaml": "resources: [cm.yaml]\n",
+			"app/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: default\ndata:\n  key: " + value + "\n",
+		}
+		for name, content := range files {
+			if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, args := range [][]string{{"add", "-A"}, {"commit", "-q", "-m", value}} {
+			cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+			}
+		}
+	}
+	if out, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+	commit("before")
+	commit("after")
+
+	p, err := preview.New(preview.WithKustomizations([]string{"app"}), preview.WithLogger(logr.Discard()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var out bytes.Buffer
+	if _, err := p.DiffGit(dir, "HEAD~1", "HEAD", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "-  key: before") || !strings.Contains(out.String(), "+  key: after") {
+		t.Errorf("expected the changed value in the diff:\n%s", out.String())
+	}
+}
+
+func TestDependencyErrors(t *testing.T) {
+	dirs := map[string]string{}
+	for side, deps := range map[string]string{"a": "", "b": "  dependsOn:\n  - name: infra\n"} {
+		dir := t.TempDir()
+		ks := "apiVersion: kustomize.toolkit.fluxcd.io/v1beta2\nkind: Kustomization\nmetadata:\n  name: apps\n  namespace: flux-system\nspec:\n  path: ./apps\n" + deps
+		if err := os.WriteFile(filepath.Join(dir, "ks.yaml"), []byte(ks), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		dirs[side] = dir
+	}
+
+	p, err := preview.New(preview.WithKustomizations([]string{"."}), preview.WithLogger(logr.Discard()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var out bytes.Buffer
+	result, err := p.Diff(dirs["a"], dirs["b"], &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "B: Kustomization flux-system/apps depends on missing Kustomization flux-system/infra"
+	if len(result.DependencyErrors) != 1 || result.DependencyErrors[0].String() != want {
+		t.Errorf("unexpected dependency errors %v", result.DependencyErrors)
+	}
+	if !strings.Contains(out.String(), "# dependency errors\n"+want+"\n") || !strings.Contains(out.String(), "+  dependsOn:") {
+		t.Errorf("expected the dependency error and the diff:\n%s", out.String())
+	}
+
+	out.Reset()
+	var verr *graph.ValidationError
+	if err := p.Graph(dirs["b"], graph.FormatMermaid, &out); !errors.As(err, &verr) {
+		t.Errorf("expected a validation error, got %v", err)
+	}
+	if !strings.Contains(out.String(), "Kustomization flux-system/infra (missing)") {
+		t.Errorf("expected the graph to be written with the missing dependency:\n%s", out.String())
+	}
+}
@@ -0,0 +1,65 @@
+package preview
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/tobiash/flux-helm-preview/pkg/helmrender"
+)
+
+// chartVersions holds the chart versions HelmReleases were rendered with per unit
+type chartVersions map[string][]helmrender.Resolution
+
+func (v chartVersions) find(unit string, r helmrender.Resolution) *helmrender.Resolution {
+	for i, o := range v[unit] {
+		if o.Release == r.Release && o.Repository == r.Repository && o.Chart == r.Chart {
+			return &v[unit][i]
+		}
+	}
+	return nil
+}
+
+// writeChartVersions writes the versions that version ranges and tags of b resolved to, and the
+// version they resolved to in a if it differs
+func writeChartVersions(out io.Writer, a, b chartVersions) error {
+	var lines []string
+	for unit, resolutions := range b {
+		for _, r := range resolutions {
+			if !r.IsRange() {
+				continue
+			}
+			name := r.Release
+			if unit != "" {
+				name = unit + "/" + name
+			}
+			kind, constraint := "range", r.Constraint
+			if constraint == "" {
+				constraint = "*"
+			} else if _, err := semver.NewConstraint(constraint); err != nil {
+				kind = "tag"
+			}
+			line := fmt.Sprintf("%s: %s %s %q resolved to %s", name, r.Chart, kind, constraint, r.Version)
+			if o := a.find(unit, r); o != nil && o.Version != r.Version {
+				line += fmt.Sprintf(" (was %s)", o.Version)
+			} else if o != nil && o.Digest != r.Digest {
+				line += " (content changed)"
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	sort.Strings(lines)
+	if _, err := fmt.Fprintln(out, "# chart versions"); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(out, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
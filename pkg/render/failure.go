@@ -0,0 +1,46 @@
+package render
+
+import "fmt"
+
+// Failure is a HelmRelease or Flux Kustomization which could not be rendered, recorded instead
+// of aborting when rendering partially
+type Failure struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Labels select the objects rendered from the failed object
+	Labels map[string]string
+	Err    error
+}
+
+func (f Failure) Error() string {
+	return fmt.Sprintf("%s %s/%s: %v", f.Kind, f.Namespace, f.Name, f.Err)
+}
+
+func (f Failure) Unwrap() error {
+	return f.Err
+}
+
+// RemoveFailed removes the objects rendered from the failed object f
+func (r *Render) RemoveFailed(f Failure) error {
+	if len(f.Labels) == 0 {
+		return nil
+	}
+	for _, res := range r.Resources() {
+		labels := res.GetLabels()
+		matches := true
+		for k, v := range f.Labels {
+			if labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if err := r.Remove(res.CurId()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,31 +1,132 @@
 package render
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/discover"
+	"github.com/tobiash/flux-helm-preview/pkg/sops"
+	"sigs.k8s.io/kustomize/api/hasher"
 	"sigs.k8s.io/kustomize/api/krusty"
 	"sigs.k8s.io/kustomize/api/resmap"
+	"sigs.k8s.io/kustomize/api/resource"
 	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/resid"
 )
 
 // Render is a set of rendered yaml
 type Render struct {
 	resmap.ResMap
 	kustomizer *krusty.Kustomizer
-	log logr.Logger
+	decryptor  *sops.Decryptor
+	fixtures   resmap.ResMap
+	log        logr.Logger
 }
 
 func NewDefaultRender(log logr.Logger) *Render {
 	return &Render{
-		ResMap:    resmap.New(),
+		ResMap:     resmap.New(),
 		kustomizer: krusty.MakeKustomizer(krusty.MakeDefaultOptions()),
-		log: log,
+		log:        log,
+	}
+}
+
+// SetDecryptor configures the decryptor used to look up SOPS encrypted resources
+func (r *Render) SetDecryptor(d *sops.Decryptor) {
+	r.decryptor = d
+}
+
+// SetFixtures makes the resources of fixtures visible to Lookup without adding them to the render
+func (r *Render) SetFixtures(fixtures resmap.ResMap) {
+	r.fixtures = fixtures
+}
+
+// Lookup returns the resource with the given id, or nil if it is neither present nor a fixture.
+// SOPS encrypted resources are returned decrypted.
+func (r *Render) Lookup(id resid.ResId) (*resource.Resource, error) {
+	res, err := r.GetById(id)
+	if err != nil && r.fixtures != nil {
+		res, err = r.fixtures.GetById(id)
+	}
+	if err != nil {
+		return nil, nil
 	}
+	if !sops.IsEncrypted(res) {
+		return res, nil
+	}
+	if r.decryptor == nil {
+		return nil, fmt.Errorf("%s is SOPS encrypted, an age key is required to decrypt it", id)
+	}
+	return r.decryptor.Decrypt(res)
 }
 
+// AddKustomization renders the kustomization at path. Directories without a kustomization
+// file are rendered like Flux does, by including all manifests found below path.
 func (r *Render) AddKustomization(fSys filesys.FileSystem, path string) error {
+	if !discover.HasKustomization(fSys, path) {
+		return r.addDirectory(fSys, path)
+	}
 	resmap, err := r.kustomizer.Run(fSys, path)
 	if err != nil {
 		return err
 	}
 	return r.AppendAll(resmap)
 }
+
+func (r *Render) addDirectory(fSys filesys.FileSystem, path string) error {
+	r.log.Info("no kustomization file found, including all manifests", "path", path)
+	return fSys.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p == path {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if discover.HasKustomization(fSys, p) {
+				if err := r.AddKustomization(fSys, p); err != nil {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := filepath.Ext(p)
+		if ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+		content, err := fSys.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if !isManifest(content) {
+			return nil
+		}
+		rm, err := resmap.NewFactory(resource.NewFactory(&hasher.Hasher{})).NewResMapFromBytes(content)
+		if err != nil {
+			return fmt.Errorf("error rendering %s: %w", p, err)
+		}
+		return r.AppendAll(rm)
+	})
+}
+
+// isManifest reports whether content contains at least one Kubernetes object
+func isManifest(content []byte) bool {
+	nodes, err := kio.FromBytes(content)
+	if err != nil {
+		return false
+	}
+	for _, n := range nodes {
+		if n.GetApiVersion() != "" && n.GetKind() != "" {
+			return true
+		}
+	}
+	return false
+}
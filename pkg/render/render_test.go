@@ -0,0 +1,83 @@
+package render_test
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/tobiash/flux-helm-preview/pkg/render"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+)
+
+func TestLookupFixtures(t *testing.T) {
+	fs := filesys.MakeFsInMemory()
+	files := map[string]string{
+		"/repo/cm.yaml":          "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: repo\n  namespace: default\n",
+		"/fixtures/secret.yaml":  "apiVersion: v1\nkind: Secret\nmetadata:\n  name: external\n  namespace: default\n",
+		"/fixtures/override.yml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: repo\n  namespace: default\ndata:\n  from: fixture\n",
+	}
+	for p, c := range files {
+		if err := fs.WriteFile(p, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fixtures := render.NewDefaultRender(logr.Discard())
+	if err := fixtures.AddKustomization(fs, "/fixtures"); err != nil {
+		t.Fatal(err)
+	}
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, "/repo"); err != nil {
+		t.Fatal(err)
+	}
+	r.SetFixtures(fixtures.ResMap)
+
+	secret, err := r.Lookup(resid.NewResIdWithNamespace(resid.NewGvk("", "v1", "Secret"), "external", "default"))
+	if err != nil || secret == nil {
+		t.Fatalf("expected fixture to be found, got %v, %v", secret, err)
+	}
+	cm, err := r.Lookup(resid.NewResIdWithNamespace(resid.NewGvk("", "v1", "ConfigMap"), "repo", "default"))
+	if err != nil || cm == nil || cm.GetDataMap()["from"] != "" {
+		t.Errorf("expected object of the repository to take precedence over fixtures, got %v, %v", cm, err)
+	}
+	if r.Size() != 1 {
+		t.Errorf("fixtures must not be part of the render, got %d resources", r.Size())
+	}
+}
+
+func TestRemoveFailed(t *testing.T) {
+	fs := filesys.MakeFsInMemory()
+	if err := fs.WriteFile("/repo/cms.yaml", []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: failed
+  namespace: default
+  labels:
+    helm.toolkit.fluxcd.io/name: broken
+    helm.toolkit.fluxcd.io/namespace: default
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+  namespace: default
+  labels:
+    helm.toolkit.fluxcd.io/name: broken
+    helm.toolkit.fluxcd.io/namespace: other
+`)); err != nil {
+		t.Fatal(err)
+	}
+	r := render.NewDefaultRender(logr.Discard())
+	if err := r.AddKustomization(fs, "/repo"); err != nil {
+		t.Fatal(err)
+	}
+	err := r.RemoveFailed(render.Failure{Labels: map[string]string{
+		"helm.toolkit.fluxcd.io/name":      "broken",
+		"helm.toolkit.fluxcd.io/namespace": "default",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 1 || r.Resources()[0].GetName() != "other" {
+		t.Errorf("expected only the objects of the failed release to be removed, got %d resources", r.Size())
+	}
+}
@@ -0,0 +1,465 @@
+package sops
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"sigs.k8s.io/kustomize/api/resource"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const metadataKey = "sops"
+
+var encryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// IsEncrypted reports whether res is a SOPS encrypted document
+func IsEncrypted(res *resource.Resource) bool {
+	m, err := res.Map()
+	if err != nil {
+		return false
+	}
+	meta, ok := m[metadataKey].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = meta["mac"]
+	return ok
+}
+
+// Decryptor decrypts SOPS documents encrypted for age recipients
+type Decryptor struct {
+	identities []age.Identity
+}
+
+// NewDecryptor reads age identities in the format of an age key file
+func NewDecryptor(keys io.Reader) (*Decryptor, error) {
+	identities, err := age.ParseIdentities(keys)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing age keys: %w", err)
+	}
+	return &Decryptor{identities: identities}, nil
+}
+
+// Decrypt returns a decrypted copy of res without SOPS metadata
+func (d *Decryptor) Decrypt(res *resource.Resource) (*resource.Resource, error) {
+	result := res.DeepCopy()
+	doc, err := parse(result)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %w", res.CurId(), err)
+	}
+	key, err := d.dataKey(doc.meta)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %w", res.CurId(), err)
+	}
+	if err := doc.decrypt(key, setScalar); err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %w", res.CurId(), err)
+	}
+	doc.removeMetadata()
+	return result, nil
+}
+
+// dataKey decrypts the SOPS data key with one of the age identities
+func (d *Decryptor) dataKey(meta metadata) ([]byte, error) {
+	if len(meta.Age) == 0 {
+		return nil, fmt.Errorf("document is not encrypted for any age recipient")
+	}
+	var lastErr error
+	for _, entry := range meta.Age {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(entry.Enc)), d.identities...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("no age key matches any recipient: %w", lastErr)
+}
+
+// metadata is the part of the SOPS metadata needed to decrypt documents encrypted for age
+type metadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+	LastModified            string `yaml:"lastmodified"`
+	MAC                     string `yaml:"mac"`
+	UnencryptedSuffix       string `yaml:"unencrypted_suffix"`
+	EncryptedSuffix         string `yaml:"encrypted_suffix"`
+	UnencryptedRegex        string `yaml:"unencrypted_regex"`
+	EncryptedRegex          string `yaml:"encrypted_regex"`
+	UnencryptedCommentRegex string `yaml:"unencrypted_comment_regex"`
+	EncryptedCommentRegex   string `yaml:"encrypted_comment_regex"`
+	MACOnlyEncrypted        bool   `yaml:"mac_only_encrypted"`
+	Version                 string `yaml:"version"`
+}
+
+// shouldBeEncrypted tells whether SOPS encrypted the value at path, following the rules of
+// sops.Tree.shouldBeEncrypted
+func (m metadata) shouldBeEncrypted(path []string) bool {
+	encrypted := true
+	if m.UnencryptedSuffix != "" && anyKey(path, func(k string) bool { return strings.HasSuffix(k, m.UnencryptedSuffix) }) {
+		encrypted = false
+	}
+	if m.EncryptedSuffix != "" {
+		encrypted = anyKey(path, func(k string) bool { return strings.HasSuffix(k, m.EncryptedSuffix) })
+	}
+	if m.UnencryptedRegex != "" && anyKey(path, func(k string) bool { return matches(m.UnencryptedRegex, k) }) {
+		encrypted = false
+	}
+	if m.EncryptedRegex != "" {
+		encrypted = anyKey(path, func(k string) bool { return matches(m.EncryptedRegex, k) })
+	}
+	return encrypted
+}
+
+func anyKey(path []string, fn func(string) bool) bool {
+	for _, k := range path {
+		if fn(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(expr, s string) bool {
+	matched, _ := regexp.MatchString(expr, s)
+	return matched
+}
+
+// macOnlyEncryptedInitialization starts the MAC of documents encrypted with mac_only_encrypted,
+// see sops.MACOnlyEncryptedInitialization
+var macOnlyEncryptedInitialization = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+// document is the YAML node of a SOPS encrypted resource with its metadata
+type document struct {
+	root *yaml.Node
+	meta metadata
+}
+
+func parse(res *resource.Resource) (*document, error) {
+	doc := &document{root: res.YNode()}
+	node := doc.metadata()
+	if node == nil {
+		return nil, fmt.Errorf("document has no SOPS metadata")
+	}
+	if err := node.Decode(&doc.meta); err != nil {
+		return nil, fmt.Errorf("invalid SOPS metadata: %w", err)
+	}
+	return doc, nil
+}
+
+// metadata returns the node of the SOPS metadata
+func (doc *document) metadata() *yaml.Node {
+	for i := 0; i+1 < len(doc.root.Content); i += 2 {
+		if doc.root.Content[i].Value == metadataKey {
+			return doc.root.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func (doc *document) removeMetadata() {
+	for i := 0; i+1 < len(doc.root.Content); i += 2 {
+		if doc.root.Content[i].Value == metadataKey {
+			doc.root.Content = append(doc.root.Content[:i], doc.root.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// walk calls fn for all scalars besides the metadata in document order. SOPS authenticates
+// each value with the path of map keys leading to it, list indices are not part of the path.
+func (doc *document) walk(fn func(leaf *yaml.Node, path []string) error) error {
+	for i := 0; i+1 < len(doc.root.Content); i += 2 {
+		if key := doc.root.Content[i].Value; key != metadataKey {
+			if err := walk(doc.root.Content[i+1], []string{key}, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func walk(node *yaml.Node, path []string, fn func(leaf *yaml.Node, path []string) error) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := walk(node.Content[i+1], append(path[:len(path):len(path)], node.Content[i].Value), fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := walk(item, path, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		return fn(node, path)
+	case yaml.AliasNode:
+		return fmt.Errorf("aliases are not supported at %s", strings.Join(path, "."))
+	}
+	return nil
+}
+
+// decrypt decrypts all encrypted values, passes them to replace and verifies the MAC of the
+// document, which SOPS computes over all values in document order
+func (doc *document) decrypt(key []byte, replace func(leaf *yaml.Node, value interface{}) error) error {
+	if doc.meta.UnencryptedCommentRegex != "" || doc.meta.EncryptedCommentRegex != "" {
+		return fmt.Errorf("documents encrypted with comment regexes are not supported")
+	}
+	h := sha512.New()
+	if doc.meta.MACOnlyEncrypted {
+		h.Write(macOnlyEncryptedInitialization)
+	}
+	err := doc.walk(func(leaf *yaml.Node, path []string) error {
+		var value interface{}
+		if err := leaf.Decode(&value); err != nil {
+			return err
+		}
+		if value == nil {
+			return nil
+		}
+		encrypted := doc.meta.shouldBeEncrypted(path)
+		if encrypted {
+			s, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("value at %s is not encrypted", strings.Join(path, "."))
+			}
+			plain, err := decryptValue(s, key, strings.Join(path, ":")+":")
+			if err != nil {
+				return fmt.Errorf("unable to decrypt value at %s: %w", strings.Join(path, "."), err)
+			}
+			if err := replace(leaf, plain); err != nil {
+				return err
+			}
+			value = plain
+		}
+		if !doc.meta.MACOnlyEncrypted || encrypted {
+			b, err := macBytes(value)
+			if err != nil {
+				return fmt.Errorf("value at %s: %w", strings.Join(path, "."), err)
+			}
+			h.Write(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lastModified, err := time.Parse(time.RFC3339, doc.meta.LastModified)
+	if err != nil {
+		return fmt.Errorf("invalid lastmodified in SOPS metadata: %w", err)
+	}
+	mac, err := decryptValue(doc.meta.MAC, key, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("unable to decrypt MAC: %w", err)
+	}
+	if mac != fmt.Sprintf("%X", h.Sum(nil)) {
+		return fmt.Errorf("MAC mismatch, the document was modified after it was encrypted")
+	}
+	return nil
+}
+
+// macBytes returns the bytes SOPS adds to the MAC for value, see sops.ToBytes
+func macBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case int:
+		return []byte(strconv.Itoa(v)), nil
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	case bool:
+		if v {
+			return []byte("True"), nil
+		}
+		return []byte("False"), nil
+	case []byte:
+		return v, nil
+	case time.Time:
+		return v.MarshalText()
+	default:
+		return nil, fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+func decryptValue(value string, key []byte, additionalData string) (interface{}, error) {
+	if value == "" {
+		return "", nil
+	}
+	parts := encryptedValue.FindStringSubmatch(value)
+	if parts == nil {
+		return nil, fmt.Errorf("value is not encrypted by SOPS")
+	}
+	var data, iv, tag []byte
+	for i, dst := range []*[]byte{&data, &iv, &tag} {
+		b, err := base64.StdEncoding.DecodeString(parts[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted value: %w", err)
+		}
+		*dst = b
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, err
+	}
+	switch parts[4] {
+	case "str":
+		return string(plain), nil
+	case "int":
+		return strconv.Atoi(string(plain))
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bytes":
+		return plain, nil
+	case "bool":
+		return strconv.ParseBool(string(plain))
+	case "time":
+		var t time.Time
+		err := t.UnmarshalText(plain)
+		return t, err
+	default:
+		return nil, fmt.Errorf("unsupported type %s", parts[4])
+	}
+}
+
+// setScalar replaces the scalar node with value, keeping its comments
+func setScalar(node *yaml.Node, value interface{}) error {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	var n yaml.Node
+	if err := n.Encode(value); err != nil {
+		return err
+	}
+	node.Kind, node.Tag, node.Value, node.Style = n.Kind, n.Tag, n.Value, n.Style
+	return nil
+}
+
+// Masker replaces encrypted values with placeholders, so that SOPS documents can be diffed
+// without showing ciphertext. With a decryptor, placeholders contain a keyed hash of the
+// plaintext which only changes if the value does, and the data of all other Secrets is masked
+// as well, as decrypted values end up in Secrets rendered from valuesFrom and substituteFrom.
+type Masker struct {
+	decryptor *Decryptor
+	salt      []byte
+}
+
+func NewMasker(d *Decryptor) *Masker {
+	salt := make([]byte, 32)
+	_, _ = rand.Read(salt)
+	return &Masker{decryptor: d, salt: salt}
+}
+
+// Mask masks res in place if it is a SOPS encrypted document, or a Secret when decrypting
+func (m *Masker) Mask(res *resource.Resource) error {
+	if !IsEncrypted(res) {
+		if m.decryptor != nil && res.GetGvk().Group == "" && res.GetKind() == "Secret" {
+			return m.maskSecret(res)
+		}
+		return nil
+	}
+	doc, err := parse(res)
+	if err != nil {
+		return fmt.Errorf("error masking %s: %w", res.CurId(), err)
+	}
+
+	if m.decryptor != nil {
+		key, err := m.decryptor.dataKey(doc.meta)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s: %w", res.CurId(), err)
+		}
+		err = doc.decrypt(key, func(leaf *yaml.Node, value interface{}) error {
+			return setScalar(leaf, fmt.Sprintf("<sops-encrypted %s>", m.hash(value)))
+		})
+		if err != nil {
+			return fmt.Errorf("error masking %s: %w", res.CurId(), err)
+		}
+		doc.removeMetadata()
+		return nil
+	}
+
+	err = doc.walk(func(leaf *yaml.Node, _ []string) error {
+		if encryptedValue.MatchString(leaf.Value) {
+			return setScalar(leaf, "<sops-encrypted>")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error masking %s: %w", res.CurId(), err)
+	}
+	// Without a key only the metadata tells whether the encrypted content changed
+	return doc.metadata().Encode(newMaskedMetadata(doc.meta))
+}
+
+// maskSecret replaces the values of a plain Secret with placeholders
+func (m *Masker) maskSecret(res *resource.Resource) error {
+	doc, err := res.Map()
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"data", "stringData"} {
+		values, ok := doc[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for k, v := range values {
+			values[k] = fmt.Sprintf("<masked %s>", m.hash(v))
+		}
+	}
+	node, err := yaml.FromMap(doc)
+	if err != nil {
+		return err
+	}
+	res.SetYNode(node.YNode())
+	return nil
+}
+
+// hash returns a keyed hash of value which is stable for the lifetime of the Masker
+func (m *Masker) hash(value interface{}) string {
+	h := hmac.New(sha256.New, m.salt)
+	fmt.Fprint(h, value)
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// maskedMetadata is the SOPS metadata without the encrypted data key
+type maskedMetadata struct {
+	LastModified string   `yaml:"lastmodified,omitempty"`
+	MAC          string   `yaml:"mac,omitempty"`
+	Recipients   []string `yaml:"recipients,omitempty"`
+	Version      string   `yaml:"version,omitempty"`
+}
+
+func newMaskedMetadata(meta metadata) maskedMetadata {
+	masked := maskedMetadata{LastModified: meta.LastModified, MAC: meta.MAC, Version: meta.Version}
+	for _, entry := range meta.Age {
+		masked.Recipients = append(masked.Recipients, entry.Recipient)
+	}
+	sort.Strings(masked.Recipients)
+	return masked
+}
@@ -0,0 +1,160 @@
+package sops_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/tobiash/flux-helm-preview/pkg/sops"
+	"sigs.k8s.io/kustomize/api/provider"
+	"sigs.k8s.io/kustomize/api/resource"
+)
+
+// fixture loads a document of testdata, the encrypted ones were created with
+// `sops --encrypt --age <recipient of age.key> --encrypted-regex '^(data|stringData)$'`
+func fixture(t *testing.T, name string, replace ...string) *resource.Resource {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := provider.NewDefaultDepProvider().GetResourceFactory().FromBytes([]byte(strings.NewReplacer(replace...).Replace(string(b))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func decryptor(t *testing.T) *sops.Decryptor {
+	f, err := os.Open(filepath.Join("testdata", "age.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := sops.NewDecryptor(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDecrypt(t *testing.T) {
+	res := fixture(t, "secret.enc.yaml")
+	if !sops.IsEncrypted(res) {
+		t.Fatal("expected document to be detected as encrypted")
+	}
+
+	plain, err := decryptor(t).Decrypt(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sops.IsEncrypted(plain) {
+		t.Error("expected decrypted document to have no sops metadata")
+	}
+	expected := `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+  namespace: default
+stringData:
+  hosts:
+  - a.example.com
+  - b.example.com
+  password: hunter2
+  port: 5432
+  ratio: 0.5
+  replicas:
+  - host: db-0
+    weight: 1
+  - enabled: false
+    host: db-1
+  tls: true
+`
+	if y := plain.MustYaml(); y != expected {
+		t.Errorf("unexpected decrypted document:\n%s", y)
+	}
+
+	for name, replace := range map[string][]string{
+		"unencrypted value": {"name: db", "name: other"},
+		"removed value":     {"        - ENC", "        # ENC"},
+	} {
+		if _, err := decryptor(t).Decrypt(fixture(t, "secret.enc.yaml", replace...)); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+			t.Errorf("expected a MAC mismatch for a modified %s, got %v", name, err)
+		}
+	}
+
+	other, _ := age.GenerateX25519Identity()
+	d, _ := sops.NewDecryptor(strings.NewReader(other.String()))
+	if _, err := d.Decrypt(res); err == nil {
+		t.Error("expected decryption with a foreign key to fail")
+	}
+}
+
+func TestMask(t *testing.T) {
+	d := decryptor(t)
+
+	t.Run("without key", func(t *testing.T) {
+		res := fixture(t, "secret.enc.yaml")
+		if err := sops.NewMasker(nil).Mask(res); err != nil {
+			t.Fatal(err)
+		}
+		y := res.MustYaml()
+		if !strings.Contains(y, "password: <sops-encrypted>") || strings.Contains(y, "AGE ENCRYPTED") || !strings.Contains(y, "mac:") {
+			t.Errorf("unexpected masked document:\n%s", y)
+		}
+	})
+
+	t.Run("with key", func(t *testing.T) {
+		m := sops.NewMasker(d)
+		a := fixture(t, "secret.enc.yaml")
+		b := fixture(t, "secret.reencrypted.enc.yaml")
+		c := fixture(t, "secret.changed.enc.yaml")
+		for _, res := range []*resource.Resource{a, b, c} {
+			if err := m.Mask(res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if a.MustYaml() != b.MustYaml() {
+			t.Errorf("re-encrypted identical values should mask identically:\n%s\n%s", a.MustYaml(), b.MustYaml())
+		}
+		if a.MustYaml() == c.MustYaml() {
+			t.Error("changed values should mask differently")
+		}
+		if strings.Contains(a.MustYaml(), "hunter2") || strings.Contains(a.MustYaml(), "sops:") {
+			t.Errorf("unexpected masked document:\n%s", a.MustYaml())
+		}
+	})
+
+	t.Run("plain secrets", func(t *testing.T) {
+		plain := func(value string) *resource.Resource {
+			res, err := provider.NewDefaultDepProvider().GetResourceFactory().FromBytes([]byte(
+				"apiVersion: v1\nkind: Secret\nmetadata:\n  name: rendered\nstringData:\n  password: " + value + "\ndata:\n  token: aHVudGVyMg==\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return res
+		}
+		res := plain("hunter2")
+		if err := sops.NewMasker(nil).Mask(res); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(res.MustYaml(), "password: hunter2") {
+			t.Errorf("expected plain secrets to be kept without a key:\n%s", res.MustYaml())
+		}
+
+		m := sops.NewMasker(d)
+		a, b := plain("hunter2"), plain("changed")
+		for _, res := range []*resource.Resource{a, b} {
+			if err := m.Mask(res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if y := a.MustYaml(); strings.Contains(y, "hunter2") || strings.Contains(y, "aHVudGVyMg==") || !strings.Contains(y, "password: <masked ") {
+			t.Errorf("expected the secret data to be masked:\n%s", y)
+		}
+		if a.MustYaml() == b.MustYaml() {
+			t.Error("changed values should mask differently")
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package sources
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+// ErrUnmapped is returned when a source is referenced that is not mapped to a local path
+var ErrUnmapped = errors.New("source is not mapped to a local path")
+
+// DefaultSelf is the source that refers to the repository under preview unless configured otherwise,
+// matching the GitRepository created by flux bootstrap
+var DefaultSelf = Ref{Kind: "GitRepository", Namespace: "flux-system", Name: "flux-system"}
+
+// Ref identifies a Flux source object
+type Ref struct {
+	Kind      string `yaml:"kind"`
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+}
+
+func (r Ref) String() string {
+	return fmt.Sprintf("%s/%s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// Source maps a Flux source to a local directory or tarball. An empty path maps the
+// source to the repository under preview.
+type Source struct {
+	Ref  `yaml:",inline"`
+	Path string `yaml:"path,omitempty"`
+}
+
+type Config struct {
+	Sources []Source `yaml:"sources"`
+}
+
+// Location is a directory within a file system
+type Location struct {
+	FS   filesys.FileSystem
+	Path string
+}
+
+// Map resolves Flux sources to local file systems
+type Map struct {
+	paths    map[Ref]string
+	lock     sync.Mutex
+	archives map[string]filesys.FileSystem
+}
+
+// Load reads a source map from r, resolving relative paths against baseDir
+func Load(r io.Reader, baseDir string) (*Map, error) {
+	var cfg Config
+	if err := yaml.NewDecoder(r).Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error parsing source map: %w", err)
+	}
+	return New(cfg, baseDir)
+}
+
+func New(cfg Config, baseDir string) (*Map, error) {
+	m := &Map{
+		paths:    map[Ref]string{},
+		archives: map[string]filesys.FileSystem{},
+	}
+	for _, s := range cfg.Sources {
+		if s.Kind == "" || s.Name == "" || s.Namespace == "" {
+			return nil, fmt.Errorf("source map entry %s must have kind, namespace and name", s.Ref)
+		}
+		p := s.Path
+		if p != "" && !filepath.IsAbs(p) {
+			p = filepath.Join(baseDir, p)
+		}
+		m.paths[s.Ref] = p
+	}
+	return m, nil
+}
+
+// WithSelf returns a resolver for a render of the repository at self
+func (m *Map) WithSelf(self Location) *Resolver {
+	return &Resolver{m: m, self: self}
+}
+
+func (m *Map) resolve(ref Ref, self Location) (Location, error) {
+	p, ok := m.paths[ref]
+	if !ok {
+		if ref == DefaultSelf {
+			return self, nil
+		}
+		return Location{}, fmt.Errorf("%w: %s, add it to the source map", ErrUnmapped, ref)
+	}
+	if p == "" {
+		return self, nil
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return Location{}, fmt.Errorf("error resolving source %s: %w", ref, err)
+	}
+	if fi.IsDir() {
+		return Location{FS: filesys.MakeFsOnDisk(), Path: p}, nil
+	}
+	fs, err := m.archive(p)
+	if err != nil {
+		return Location{}, fmt.Errorf("error resolving source %s: %w", ref, err)
+	}
+	return Location{FS: fs, Path: "/"}, nil
+}
+
+// archive extracts the tarball at p into memory, once per map
+func (m *Map) archive(p string) (filesys.FileSystem, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if fs, ok := m.archives[p]; ok {
+		return fs, nil
+	}
+	fs, err := extractTarball(p)
+	if err != nil {
+		return nil, err
+	}
+	m.archives[p] = fs
+	return fs, nil
+}
+
+func extractTarball(p string) (filesys.FileSystem, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(p, ".gz") || strings.HasSuffix(p, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	fs := filesys.MakeFsInMemory()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", p, err)
+		}
+		name := path.Join("/", hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fs.MkdirAll(name); err != nil {
+				return nil, err
+			}
+		case tar.TypeReg:
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			if err := fs.WriteFile(name, content); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fs, nil
+}
+
+// Resolver resolves sources for a render of a single repository
+type Resolver struct {
+	m    *Map
+	self Location
+}
+
+// Resolve returns the local location of the referenced source
+func (r *Resolver) Resolve(ref Ref) (Location, error) {
+	return r.m.resolve(ref, r.self)
+}
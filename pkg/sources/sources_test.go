@@ -0,0 +1,119 @@
+package sources_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tobiash/flux-helm-preview/pkg/sources"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+func writeTarball(t *testing.T, p string, files map[string]string) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "platform", "apps"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "platform", "apps", "cm.yaml"), []byte("from: dir\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeTarball(t, filepath.Join(dir, "charts.tar.gz"), map[string]string{"./apps/cm.yaml": "from: tarball\n"})
+
+	m, err := sources.Load(strings.NewReader(`sources:
+- kind: GitRepository
+  namespace: flux-system
+  name: platform
+  path: platform
+- kind: Bucket
+  namespace: flux-system
+  name: charts
+  path: charts.tar.gz
+- kind: GitRepository
+  namespace: apps
+  name: self
+- kind: GitRepository
+  namespace: flux-system
+  name: missing
+  path: does-not-exist
+`), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := sources.Location{FS: filesys.MakeFsInMemory(), Path: "/self"}
+	if err := self.FS.WriteFile("/self/apps/cm.yaml", []byte("from: self\n")); err != nil {
+		t.Fatal(err)
+	}
+	resolver := m.WithSelf(self)
+
+	tests := []struct {
+		name    string
+		ref     sources.Ref
+		want    string
+		wantErr string
+	}{
+		{name: "flux bootstrap source", ref: sources.DefaultSelf, want: "from: self\n"},
+		{name: "mapped to the repository under preview", ref: sources.Ref{Kind: "GitRepository", Namespace: "apps", Name: "self"}, want: "from: self\n"},
+		{name: "directory relative to the source map", ref: sources.Ref{Kind: "GitRepository", Namespace: "flux-system", Name: "platform"}, want: "from: dir\n"},
+		{name: "tarball", ref: sources.Ref{Kind: "Bucket", Namespace: "flux-system", Name: "charts"}, want: "from: tarball\n"},
+		{name: "unmapped", ref: sources.Ref{Kind: "GitRepository", Namespace: "flux-system", Name: "other"}, wantErr: "GitRepository/flux-system/other"},
+		{name: "kind must match", ref: sources.Ref{Kind: "OCIRepository", Namespace: "flux-system", Name: "platform"}, wantErr: "OCIRepository/flux-system/platform"},
+		{name: "missing path", ref: sources.Ref{Kind: "GitRepository", Namespace: "flux-system", Name: "missing"}, wantErr: "does-not-exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := resolver.Resolve(tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := loc.FS.ReadFile(filepath.Join(loc.Path, "apps", "cm.yaml"))
+			if err != nil || string(got) != tt.want {
+				t.Errorf("got %q (%v), want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := resolver.Resolve(sources.Ref{Kind: "GitRepository", Namespace: "flux-system", Name: "other"}); !errors.Is(err, sources.ErrUnmapped) {
+		t.Errorf("expected ErrUnmapped, got %v", err)
+	}
+}
+
+func TestNewRequiresRef(t *testing.T) {
+	_, err := sources.New(sources.Config{Sources: []sources.Source{{Ref: sources.Ref{Kind: "GitRepository", Name: "platform"}}}}, "")
+	if err == nil || !strings.Contains(err.Error(), "must have kind, namespace and name") {
+		t.Errorf("expected an incomplete entry to be rejected, got %v", err)
+	}
+}